@@ -12,23 +12,41 @@ import (
 
 // Compute centroid by selecting the vector with the highest average cosine similarity
 func computeCentroid(vectors [][]float64) []float64 {
-	bestCandidate := vectors[0]
+	sparse := make([]utils.SparseVector, len(vectors))
+	members := make([]int, len(vectors))
+	for i, vec := range vectors {
+		sparse[i] = utils.NewSparseVector(vec)
+		members[i] = i
+	}
+	return vectors[computeSparseCentroid(members, sparse)]
+}
+
+// computeSparseCentroid is computeCentroid over the sparse vectors of the
+// cluster members, returning the index of the one picked.
+func computeSparseCentroid(members []int, sparse []utils.SparseVector) int {
+	best := members[0]
 	bestSimilarity := -1.0
 
 	// Iterate through all vectors and compute their average similarity to others
-	for i := 0; i < len(vectors); i++ {
-		averageSimilarity := utils.AverageCosineDistance(vectors[i], vectors)
+	for _, i := range members {
+		var total float64
+		for _, j := range members {
+			total += utils.SparseCosineDistance(sparse[i], sparse[j])
+		}
+		averageSimilarity := total / float64(len(members))
 
 		// Update the best candidate if the current vector has higher average similarity
 		if averageSimilarity > bestSimilarity {
-			bestCandidate = vectors[i]
+			best = i
 			bestSimilarity = averageSimilarity
 		}
 	}
-	return bestCandidate
+	return best
 }
 
-// K-Means clustering (ensures each cluster contains exactly K vectors)
+// K-Means clustering (ensures each cluster contains exactly K vectors). The
+// distances are computed on sparse copies of the vectors, since TF-IDF
+// vectors are mostly zeros.
 func Cluster(vectors [][]float64, names []string, iterations int) ([][]float64, []string) {
 	n := len(vectors)
 	k := int(math.Sqrt(float64(n)))
@@ -37,29 +55,30 @@ func Cluster(vectors [][]float64, names []string, iterations int) ([][]float64,
 	if n%k != 0 {
 		panic("The number of vectors must be divisible by K")
 	}
+	sparse := make([]utils.SparseVector, n)
+	for i, vec := range vectors {
+		sparse[i] = utils.NewSparseVector(vec)
+	}
 
 	// Initialize centroids randomly (can be optimized with K-means++)
-	centroids := make([][]float64, k)
+	centroids := make([]int, k)
 	for i := range centroids {
-		centroids[i] = vectors[rand.Intn(n)]
+		centroids[i] = rand.Intn(n)
 	}
 
-	// Create the initial empty clusters
-	clusters := make([][][]float64, k)
-	clusterNames := make([][]string, k) 
+	// Create the initial empty clusters, as indexes into vectors
+	members := make([][]int, k)
 
 	for iter := 0; iter < iterations; iter++ {
 		// Reset clusters for this iteration
-		clusters = make([][][]float64, k)
-		clusterNames = make([][]string, k) // Reset names for each cluster
-		clusterSizes := make([]int, k)     // Track the number of vectors in each cluster
+		members = make([][]int, k)
 
 		// Assign vectors to the closest centroid
-		for idx, vec := range vectors {
+		for idx := range vectors {
 			// Find the nearest centroid
 			minDist, bestCluster := math.MaxFloat64, 0
 			for j, cent := range centroids {
-				dist := utils.CosineDistance(vec, cent)
+				dist := utils.SparseCosineDistance(sparse[idx], sparse[cent])
 				if dist < minDist {
 					minDist = dist
 					bestCluster = j
@@ -67,18 +86,14 @@ func Cluster(vectors [][]float64, names []string, iterations int) ([][]float64,
 			}
 
 			// If the chosen cluster has less than K vectors, assign the vector
-			if clusterSizes[bestCluster] < k {
-				clusters[bestCluster] = append(clusters[bestCluster], vec)
-				clusterNames[bestCluster] = append(clusterNames[bestCluster], names[idx])
-				clusterSizes[bestCluster]++
+			if len(members[bestCluster]) < k {
+				members[bestCluster] = append(members[bestCluster], idx)
 			} else {
 				// If the cluster already has K vectors, find the next best cluster
 				// and assign the vector there.
 				for i := 0; i < k; i++ {
-					if clusterSizes[i] < k {
-						clusters[i] = append(clusters[i], vec)
-						clusterNames[i] = append(clusterNames[i], names[idx])
-						clusterSizes[i]++
+					if len(members[i]) < k {
+						members[i] = append(members[i], idx)
 						break
 					}
 				}
@@ -87,13 +102,23 @@ func Cluster(vectors [][]float64, names []string, iterations int) ([][]float64,
 
 		// Update centroids (compute centroid for non-empty clusters)
 		for i := range centroids {
-			if len(clusters[i]) > 0 {
-				centroids[i] = computeCentroid(clusters[i])
+			if len(members[i]) > 0 {
+				centroids[i] = computeSparseCentroid(members[i], sparse)
 			}
 		}
 	}
 
-	return ToVector(centroids, k, clusters, clusterNames, true)
+	centroidVectors := make([][]float64, k)
+	clusters := make([][][]float64, k)
+	clusterNames := make([][]string, k)
+	for i := range members {
+		centroidVectors[i] = vectors[centroids[i]]
+		for _, idx := range members[i] {
+			clusters[i] = append(clusters[i], vectors[idx])
+			clusterNames[i] = append(clusterNames[i], names[idx])
+		}
+	}
+	return ToVector(centroidVectors, k, clusters, clusterNames, true)
 }
 
 // Move the target element (of type T) to the first position in the slice
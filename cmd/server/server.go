@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 
 	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/data"
 	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/hem"
@@ -16,36 +21,141 @@ import (
 type Item struct {
     Query string   `json:"query"`
     Data  []string `json:"data"`
+    // Pipeline optionally names the cleaning pipeline the client expects, as
+    // data.Pipeline.ID. The request is refused if the server uses another.
+    Pipeline string `json:"pipeline,omitempty"`
 }
 
 // Response represents the output data structure
 type Response struct {
     CosineSims []float64 `json:"cosine_sims"`
     QueryEnc   []float64 `json:"query_enc"`  // Changed from []int to []float64
+    Pipeline   string    `json:"pipeline"`   // data.Pipeline.ID the names were cleaned with
 }
 
-var (
-    // Pre-initialized context objects to avoid recomputing for each request
-    encCtx, decCtx, evalCtx = hem.GenerateContexts(10)
-    vectorizer              = data.NewTfidfVectorizer(2, 1)
-    globalNames             []string
-)
+// matchingServer holds the pre-initialized vectorizer and HE contexts, to
+// avoid recomputing them for each request.
+type matchingServer struct {
+    cleaner    *data.Pipeline
+    vectorizer *data.TfidfVectorizer
+    enc        hem.Encryptor
+    eval       hem.Evaluator
+    dec        hem.Decryptor
+}
+
+// modelFile caches the vectorizer fitted on global.json between restarts.
+const modelFile = "vectorizer.json"
+
+// loadVectorizer loads the saved vectorizer, or fits one on the global names
+// dataset and saves it if there is none yet.
+func loadVectorizer() (*data.TfidfVectorizer, error) {
+    vectorizer := data.NewTfidfVectorizer(2, 1)
+    if f, err := os.Open(modelFile); err == nil {
+        defer f.Close()
+        if err := vectorizer.Load(f); err != nil {
+            return nil, fmt.Errorf("failed to load %s: %w", modelFile, err)
+        }
+        return vectorizer, nil
+    } else if !errors.Is(err, fs.ErrNotExist) {
+        return nil, err
+    }
 
-func init() {
-    // Load global name data for vectorizer training
-    var err error
     loader := data.NewLoader("./")
-    globalNames, err = loader.LoadNames("global.json")
+    globalNames, err := loader.LoadNames("global.json")
     if err != nil {
-        log.Fatalf("Failed to load global names: %v", err)
+        return nil, fmt.Errorf("failed to load global names: %w", err)
     }
-
-    // Fit vectorizer with global names
     vectorizer.Fit(globalNames)
-    log.Println("Server initialized with vectorizer on global names dataset")
+    if err := saveVectorizer(vectorizer); err != nil {
+        return nil, fmt.Errorf("failed to save %s: %w", modelFile, err)
+    }
+    return vectorizer, nil
+}
+
+// saveVectorizer writes the model to a temporary file next to modelFile and
+// renames it into place, so that a failed save never leaves a truncated model
+// for the next start to trip over.
+func saveVectorizer(vectorizer *data.TfidfVectorizer) error {
+    f, err := os.CreateTemp(filepath.Dir(modelFile), filepath.Base(modelFile)+".tmp*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(f.Name())
+    if err := vectorizer.Save(f); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Close(); err != nil {
+        return err
+    }
+    return os.Rename(f.Name(), modelFile)
+}
+
+// suffixFile optionally replaces the built-in suffix standards with the
+// legal-form table of this deployment.
+const suffixFile = "suffix_standards.json"
+
+// pipelineFile optionally defines the whole cleaning pipeline. Clients must
+// clean with the same one, or their vectors won't line up with the store's.
+const pipelineFile = "pipeline.json"
+
+// loadCleaner builds the cleaning pipeline from pipelineFile, or else the
+// default pipeline with the suffix standards of suffixFile, if there is one.
+func loadCleaner() (*data.Pipeline, error) {
+    loader := data.NewLoader("./")
+    config := data.DefaultPipelineConfig()
+    if _, err := os.Stat(pipelineFile); err == nil {
+        if config, err = loader.LoadPipelineConfig(pipelineFile); err != nil {
+            return nil, fmt.Errorf("failed to load cleaning pipeline: %w", err)
+        }
+    } else if _, err := os.Stat(suffixFile); err == nil {
+        standards, err := loader.LoadSuffixStandards(suffixFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to load suffix standards: %w", err)
+        }
+        log.Printf("Loaded %d suffix standards from %s", len(standards), suffixFile)
+        for i := range config.Steps {
+            if config.Steps[i].Step == data.StepSuffixes {
+                config.Steps[i].Suffixes = standards
+            }
+        }
+    }
+    pipeline, err := data.NewPipeline(config)
+    if err != nil {
+        return nil, fmt.Errorf("failed to build cleaning pipeline: %w", err)
+    }
+    log.Printf("Cleaning names with pipeline %s", pipeline.ID())
+    return pipeline, nil
+}
+
+// newMatchingServer loads the vectorizer and generates HE contexts on a ring
+// sized for its vocabulary.
+func newMatchingServer() (*matchingServer, error) {
+    cleaner, err := loadCleaner()
+    if err != nil {
+        return nil, err
+    }
+    vectorizer, err := loadVectorizer()
+    if err != nil {
+        return nil, err
+    }
+
+    encCtx, decCtx, evalCtx, err := hem.GenerateContextsForVectorizer(hem.ProfileFast128, vectorizer, nil)
+    if err != nil {
+        return nil, fmt.Errorf("failed to generate HE contexts: %w", err)
+    }
+    hash := vectorizer.Hash()
+    log.Printf("Server initialized with vectorizer %x (%d features, %d slots)", hash[:8], vectorizer.Vocabulary.Size(), decCtx.Params().MaxSlots())
+
+    return &matchingServer{cleaner: cleaner, vectorizer: vectorizer, enc: encCtx, eval: evalCtx, dec: decCtx}, nil
 }
 
 func main() {
+    srv, err := newMatchingServer()
+    if err != nil {
+        log.Fatal(err)
+    }
+
     r := gin.Default()
 
     // Configure CORS
@@ -57,7 +167,7 @@ func main() {
     }))
 
     // Define routes
-    r.POST("/", processEntityMatchingRequest)
+    r.POST("/", srv.processEntityMatchingRequest)
 
     // Start server
     log.Println("Starting server on :8080...")
@@ -67,7 +177,7 @@ func main() {
 }
 
 
-func processEntityMatchingRequest(c *gin.Context) {
+func (s *matchingServer) processEntityMatchingRequest(c *gin.Context) {
     // Parse request data
     var item Item
     if err := c.ShouldBindJSON(&item); err != nil {
@@ -80,8 +190,14 @@ func processEntityMatchingRequest(c *gin.Context) {
         return
     }
 
+    if item.Pipeline != "" && item.Pipeline != s.cleaner.ID() {
+        c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("client expects cleaning pipeline %s, server uses %s", item.Pipeline, s.cleaner.ID())})
+        return
+    }
+    log.Printf("Cleaning request with pipeline %s", s.cleaner.ID())
+
     // Process with homomorphic encryption
-    cosineSims, err := computeHECosineSimilarities(item.Query, item.Data)
+    cosineSims, err := s.computeHECosineSimilarities(c.Request.Context(), item.Query, item.Data)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
         return
@@ -92,15 +208,16 @@ func processEntityMatchingRequest(c *gin.Context) {
     c.JSON(http.StatusOK, Response{
         CosineSims: cosineSims,
         QueryEnc:   utils.GenerateTestVector(1024),
+        Pipeline:   s.cleaner.ID(),
     })
 }
 
-func computeHECosineSimilarities(query string, store []string) ([]float64, error) {
+func (s *matchingServer) computeHECosineSimilarities(ctx context.Context, query string, store []string) ([]float64, error) {
     // Preprocess data first using existing data cleaning functions
-    cleanedQuery := data.CleanCompanyName(query)
+    cleanedQuery := s.cleaner.Clean(query)
     cleanedStore := make([]string, len(store))
     for i, name := range store {
-        cleanedStore[i] = data.CleanCompanyName(name)
+        cleanedStore[i] = s.cleaner.Clean(name)
     }
     
     // Log the cleaning results for debugging
@@ -110,54 +227,47 @@ func computeHECosineSimilarities(query string, store []string) ([]float64, error
     }
     
     // Transform cleaned data
-    queryVector := vectorizer.Transform(cleanedQuery)
-    storeVectors := vectorizer.BatchTransform(cleanedStore)
+    querySparse := s.vectorizer.TransformSparse(cleanedQuery)
+    storeSparse := s.vectorizer.BatchTransformSparse(cleanedStore)
 
     // Normalize vectors
-    utils.NormalizeVector(&queryVector)
-    for i := range storeVectors {
-        utils.NormalizeVector(&storeVectors[i])
+    utils.NormalizeSparse(querySparse)
+    for i := range storeSparse {
+        utils.NormalizeSparse(storeSparse[i])
     }
 
-    // Prepare query vector
-    queryVectors := make([][]float64, 1)
-    queryVectors[0] = queryVector
-
     // Log expected plaintext similarities for verification:
     log.Println("Computing plaintext similarities for verification:")
     for i, name := range store {
-        sim := utils.DotProduct(queryVector, storeVectors[i])
+        sim := utils.SparseDotProduct(querySparse, storeSparse[i])
         log.Printf("  %s: %.6f", name, sim)
     }
 
+    // Expand to dense vectors only for encoding
+    size := s.vectorizer.Size()
+    queryVectors := [][]float64{querySparse.Dense(size)}
+    storeVectors := utils.SparseDense(storeSparse, size)
+
     // Batch encrypt the query vector
-    encryptedQuery := encCtx.BatchEncrypt(queryVectors)
-    enc := encryptedQuery[0]
-    fmt.Println("Encrypted query vector:", len(enc.Value))
+    encryptedQuery, err := s.enc.BatchEncrypt(ctx, queryVectors)
+    if err != nil {
+        return nil, err
+    }
 
     // Compute cosine similarities using HE
-    resultMatrix, err := evalCtx.BatchDotProduct(encryptedQuery, storeVectors)
+    resultMatrix, err := s.eval.BatchDotProduct(ctx, encryptedQuery, storeVectors)
     if err != nil {
         return nil, err
     }
 
-    // Decrypt the results
-    cosineSimilarities := make([]float64, len(store))
-
-    // Each row contains similarities between query and all store vectors
-    decryptedBatch := decCtx.BatchDecrypt(resultMatrix[0])
+    // Decrypt the results. A failed cell is an error rather than a low score.
+    simMatrix, err := s.dec.CosineSimMatrixDecrypt(ctx, resultMatrix)
+    if err != nil {
+        return nil, err
+    }
+    cosineSimilarities := simMatrix[0]
     for j := range store {
-        if decryptedBatch[j] == nil {
-            cosineSimilarities[j] = -1 // Indicate null values with -1
-            continue
-        }
-
-        // The cosine similarity is stored in the first element due to InnerSum
-        similarity := decryptedBatch[j][0]
-        cosineSimilarities[j] = similarity
-
-        // Log for debugging
-        log.Printf("HE similarity - %s: %.6f", store[j], similarity)
+        log.Printf("HE similarity - %s: %.6f", store[j], cosineSimilarities[j])
     }
 
     return cosineSimilarities, nil
@@ -1,10 +1,13 @@
 package compression
 
 import (
+	"fmt"
 	"log"
 	"math"
 	"math/bits"
 	"math/cmplx"
+
+	"github.com/mjibson/go-dsp/fft"
 )
 
 func Prepare(x [][]float64) [][]complex128 {
@@ -126,3 +129,85 @@ func FromFloat64(x [][]float64) [][]complex128 {
 	}
 	return res
 }
+
+// FilterKind selects which part of the spectrum a Config keeps.
+type FilterKind int
+
+const (
+	NoFilter FilterKind = iota
+	LowPass
+	HighPass
+	BandPass
+	BandStop
+)
+
+// Config describes an FFT + filter compression of fixed-length vectors, as
+// used before encrypting TF-IDF vectors. For LowPass and HighPass only Low is
+// used as the cutoff; BandPass and BandStop use Low and High.
+type Config struct {
+	Kind FilterKind
+	Low  int
+	High int
+}
+
+// Validate checks that c can filter the spectrum of a vector of length n:
+// 0 <= Low <= n for LowPass and HighPass, and 0 <= Low <= High <= n for
+// BandPass and BandStop.
+func (c Config) Validate(n int) error {
+	switch c.Kind {
+	case NoFilter:
+	case LowPass, HighPass:
+		if c.Low < 0 || c.Low > n {
+			return fmt.Errorf("compression: cutoff %d outside [0, %d]", c.Low, n)
+		}
+	case BandPass, BandStop:
+		if c.Low < 0 || c.Low > c.High || c.High > n {
+			return fmt.Errorf("compression: band [%d, %d] outside [0, %d]", c.Low, c.High, n)
+		}
+	default:
+		return fmt.Errorf("compression: unknown filter kind %d", int(c.Kind))
+	}
+	return nil
+}
+
+// OutputSize returns the length of Compress's output for an input of length
+// n. Every kept frequency contributes a real and an imaginary part.
+func (c Config) OutputSize(n int) (int, error) {
+	if err := c.Validate(n); err != nil {
+		return 0, err
+	}
+	switch c.Kind {
+	case LowPass:
+		return 2 * c.Low, nil
+	case HighPass:
+		return 2 * (n - c.Low), nil
+	case BandPass:
+		return 2 * (c.High - c.Low), nil
+	case BandStop:
+		return 2 * (n - (c.High - c.Low)), nil
+	}
+	return n, nil
+}
+
+// Compress applies the FFT, the configured filter and ToFloat64 to x.
+// NoFilter returns x unchanged. It fails if c does not Validate for len(x).
+func (c Config) Compress(x []float64) ([]float64, error) {
+	if err := c.Validate(len(x)); err != nil {
+		return nil, err
+	}
+	if c.Kind == NoFilter {
+		return x, nil
+	}
+	spectrum := fft.FFTReal(x)
+	switch c.Kind {
+	case LowPass:
+		spectrum = LowPassFilter(spectrum, c.Low)
+	case HighPass:
+		spectrum = HighPassFilter(spectrum, c.Low)
+	case BandPass:
+		spectrum = BandPassFilter(spectrum, c.Low, c.High)
+	case BandStop:
+		spectrum = BandStopFilter(spectrum, c.Low, c.High)
+	}
+	return ToFloat64([][]complex128{spectrum})[0], nil
+}
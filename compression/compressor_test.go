@@ -75,6 +75,39 @@ func TestBandStopFilter(t *testing.T) {
 	assert.Equal(t, BandStopFilter(signal, low, high), expected)
 }
 
+func TestConfigValidate(t *testing.T) {
+	x := []float64{1, 2, 3, 4, 5, 6, 7, 8}
+	for _, cfg := range []Config{
+		{Kind: NoFilter},
+		{Kind: LowPass, Low: 3},
+		{Kind: HighPass, Low: 8},
+		{Kind: BandPass, Low: 2, High: 6},
+		{Kind: BandStop, Low: 0, High: 0},
+	} {
+		size, err := cfg.OutputSize(len(x))
+		assert.NoError(t, err, "%+v", cfg)
+		compressed, err := cfg.Compress(x)
+		assert.NoError(t, err, "%+v", cfg)
+		assert.Equal(t, size, len(compressed), "%+v", cfg)
+	}
+
+	for _, cfg := range []Config{
+		{Kind: LowPass, Low: -1},
+		{Kind: LowPass, Low: 9},
+		{Kind: HighPass, Low: 9},
+		{Kind: BandPass, Low: 5, High: 3},
+		{Kind: BandPass, Low: 2, High: 9},
+		{Kind: BandStop, Low: -1, High: 2},
+		{Kind: FilterKind(42)},
+	} {
+		assert.Error(t, cfg.Validate(len(x)), "%+v", cfg)
+		_, err := cfg.OutputSize(len(x))
+		assert.Error(t, err, "%+v", cfg)
+		_, err = cfg.Compress(x)
+		assert.Error(t, err, "%+v", cfg)
+	}
+}
+
 func BenchmarkBatchFFT(b *testing.B) {
 	var rows int = 1_000_0
 	var feats int = 1024
@@ -1,19 +1,143 @@
 package data
 
 import (
+	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/text/runes"
 	"golang.org/x/text/transform"
 	"golang.org/x/text/unicode/norm"
 )
 
+// SuffixStandards maps every standard legal-form suffix to the variants that
+// are replaced by it, e.g. "ltd" to "pty ltd" and "gmbh". Loader reads one
+// from JSON or YAML, so that every deployment can ship its own table.
+type SuffixStandards map[string][]string
+
+// Validate checks that no standard or variant is empty.
+func (s SuffixStandards) Validate() error {
+	for standard, variations := range s {
+		if strings.TrimSpace(standard) == "" {
+			return fmt.Errorf("empty suffix standard")
+		}
+		for _, variant := range variations {
+			if strings.TrimSpace(variant) == "" {
+				return fmt.Errorf("empty variant of suffix %q", standard)
+			}
+		}
+	}
+	return nil
+}
+
+// CompanyNameCleaner normalizes company names with its own suffix standards.
+// It compiles every variant into one pattern, so that a name is scanned once
+// and always cleans the same way, however the standards map iterates.
+type CompanyNameCleaner struct {
+	// Transliterate writes Cyrillic, Greek and Arabic names in Latin letters
+	// before accents and punctuation are removed, which would otherwise
+	// merge letters like "й" and "и" and then delete them.
+	Transliterate bool
+	// Punctuation decides whether punctuation is deleted, the default, or
+	// replaced with a space.
+	Punctuation PunctuationPolicy
+	// Tokens, if set, rewrites the words of the name after its suffixes
+	// were replaced.
+	Tokens *TokenPipeline
+
+	// suffixes matches any variant; its group k+1 holds a match of the
+	// variant replaced by standards[k].
+	suffixes  *regexp.Regexp
+	standards []string
+}
+
+// NewCompanyNameCleaner creates a cleaner that replaces the variants of
+// standards. Where variants overlap at the same position the longest wins, so
+// "pty ltd" is replaced whole rather than just its "ltd". A variant listed
+// under several standards, like "as" under both "ltd" and "ll", goes to the
+// one that comes first in priority; standards missing from priority rank
+// after the listed ones, in lexical order. Variants match regardless of case.
+func NewCompanyNameCleaner(standards SuffixStandards, priority ...string) *CompanyNameCleaner {
+	rank := func(standard string) int {
+		for i, p := range priority {
+			if p == standard {
+				return i
+			}
+		}
+		return len(priority)
+	}
+	owner := make(map[string]string)
+	for standard, variations := range standards {
+		for _, variant := range variations {
+			variant = strings.ToLower(variant)
+			current, taken := owner[variant]
+			if !taken || rank(standard) < rank(current) ||
+				(rank(standard) == rank(current) && standard < current) {
+				owner[variant] = standard
+			}
+		}
+	}
+
+	variants := make([]string, 0, len(owner))
+	for variant := range owner {
+		variants = append(variants, variant)
+	}
+	sort.Slice(variants, func(i, j int) bool {
+		a, b := utf8.RuneCountInString(variants[i]), utf8.RuneCountInString(variants[j])
+		if a != b {
+			return a > b
+		}
+		return variants[i] < variants[j]
+	})
+
+	c := &CompanyNameCleaner{}
+	if len(variants) == 0 {
+		return c
+	}
+	// RE2 tries alternatives in order at each position, so listing the
+	// longest variants first makes them win.
+	groups := make([]string, len(variants))
+	for k, variant := range variants {
+		groups[k] = "(" + regexp.QuoteMeta(variant) + ")"
+		c.standards = append(c.standards, owner[variant])
+	}
+	c.suffixes = regexp.MustCompile(`(?i)\b(?:` + strings.Join(groups, "|") + `)\.?\b`)
+	return c
+}
+
+// DefaultSuffixStandards returns a copy of the built-in suffix standards.
+func DefaultSuffixStandards() SuffixStandards {
+	standards := make(SuffixStandards, len(suffixStandards))
+	for standard, variations := range suffixStandards {
+		standards[standard] = append([]string(nil), variations...)
+	}
+	return standards
+}
+
+// defaultCleaner uses the built-in suffix standards.
+var defaultCleaner = NewCompanyNameCleaner(suffixStandards)
+
+// CleanCompanyName cleans name with the built-in suffix standards.
 func CleanCompanyName(name string) string {
+	return defaultCleaner.Clean(name)
+}
+
+// Clean optionally transliterates, normalizes accents and case, removes or
+// replaces punctuation, replaces legal form suffixes with their standard and finally
+// runs the token pipeline, if any.
+func (c *CompanyNameCleaner) Clean(name string) string {
+	if c.Transliterate {
+		name = Transliterate(name)
+	}
 	name = normalizeString(name)
-	name = removePunctuation(name)
-	name = replaceSuffixes(name)
+	name = c.Punctuation.apply(name)
+	name = c.replaceSuffixes(name)
+	if c.Tokens != nil {
+		name = c.Tokens.Apply(name)
+	}
 	return strings.TrimSpace(name)
 }
 
@@ -23,23 +147,37 @@ func normalizeString(s string) string {
 	return strings.ToLower(result)
 }
 
+var (
+	punctuation = regexp.MustCompile(`[^a-zA-Z0-9\s]`)
+	whitespace  = regexp.MustCompile(`\s+`)
+)
+
 func removePunctuation(s string) string {
 	// First remove all punctuation
-	reg := regexp.MustCompile(`[^a-zA-Z0-9\s]`)
-	s = reg.ReplaceAllString(s, "")
-	
+	s = punctuation.ReplaceAllString(s, "")
+
 	// Then collapse multiple spaces to single space
-	spaceReg := regexp.MustCompile(`\s+`)
-	return spaceReg.ReplaceAllString(s, " ")
+	return whitespace.ReplaceAllString(s, " ")
 }
 
-func replaceSuffixes(name string) string {
-	for standard, variations := range suffixStandards {
-		for _, variant := range variations {
-			pattern := `(?i)\b` + regexp.QuoteMeta(variant) + `\.?\b`
-			re := regexp.MustCompile(pattern)
-			name = re.ReplaceAllString(name, standard)
+// replaceSuffixes replaces every variant with its standard in a single
+// left-to-right scan; a replaced suffix is never matched again.
+func (c *CompanyNameCleaner) replaceSuffixes(name string) string {
+	if c.suffixes == nil {
+		return name
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range c.suffixes.FindAllStringSubmatchIndex(name, -1) {
+		b.WriteString(name[last:m[0]])
+		for k := range c.standards {
+			if m[2*k+2] >= 0 {
+				b.WriteString(c.standards[k])
+				break
+			}
 		}
+		last = m[1]
 	}
-	return name
+	b.WriteString(name[last:])
+	return b.String()
 }
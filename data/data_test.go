@@ -1,20 +1,28 @@
 package data
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"unicode/utf8"
 
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/utils"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/unicode/norm"
 )
 
-func init() {
-	// Mock suffix standards for testing
-	suffixStandards = map[string][]string{
-		"inc": {"incorporated", "incorp", "inc"},
-		"llc": {"limited liability company", "l l c"},
-	}
-}
+// Mock suffix standards for testing
+var testCleaner = NewCompanyNameCleaner(SuffixStandards{
+	"inc": {"incorporated", "incorp", "inc"},
+	"llc": {"limited liability company", "l l c"},
+})
 
 func TestCleanCompanyName(t *testing.T) {
 	tests := []struct {
@@ -56,7 +64,7 @@ func TestCleanCompanyName(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := CleanCompanyName(tt.input)
+			result := testCleaner.Clean(tt.input)
 			assert.Equal(t, tt.expected, result)
 		})
 	}
@@ -109,12 +117,70 @@ func TestReplaceSuffixes(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			result := replaceSuffixes(tt.input)
+			result := testCleaner.replaceSuffixes(tt.input)
 			assert.Equal(t, tt.expected, result)
 		})
 	}
 }
 
+func TestSuffixReplacementIsStable(t *testing.T) {
+	names := []string{
+		"Acme S.A.", "Foo AS", "Bar Pty Ltd", "Baz Incorporated", "Qux Corp.", "Bolt GmbH & Co KG",
+		"Widgets Sp. z o.o.", "Nordic AS ASA",
+	}
+	first := NewCompanyNameCleaner(suffixStandards)
+	want := make([]string, len(names))
+	for i, name := range names {
+		want[i] = first.replaceSuffixes(strings.ToLower(name))
+	}
+	// Every build ranges over the map in a new order and must agree.
+	for run := 0; run < 50; run++ {
+		c := NewCompanyNameCleaner(DefaultSuffixStandards())
+		for i, name := range names {
+			assert.Equal(t, want[i], c.replaceSuffixes(strings.ToLower(name)), "Run %d, %q", run, name)
+		}
+	}
+
+	standards := SuffixStandards{
+		"co":  {"sa", "co"},
+		"ll":  {"sa", "as"},
+		"ltd": {"as", "pty ltd", "ltd"},
+	}
+	// Without priority a conflict goes to the lexically first standard.
+	c := NewCompanyNameCleaner(standards)
+	assert.Equal(t, "acme co", c.replaceSuffixes("acme sa"))
+	assert.Equal(t, "foo ll", c.replaceSuffixes("foo as"))
+	// An explicit priority overrides that.
+	c = NewCompanyNameCleaner(standards, "ltd", "ll")
+	assert.Equal(t, "acme ll", c.replaceSuffixes("acme sa"))
+	assert.Equal(t, "FOO ltd", c.replaceSuffixes("FOO AS"))
+	// The longest variant wins and replaced text is not matched again.
+	assert.Equal(t, "bar ltd", c.replaceSuffixes("bar pty ltd"))
+	assert.Equal(t, "x inc", NewCompanyNameCleaner(SuffixStandards{"x": {"inc"}, "inc": {"x"}}).replaceSuffixes("inc x"))
+	assert.Equal(t, "acme", NewCompanyNameCleaner(nil).Clean("ACME"))
+}
+
+func TestLoadSuffixStandards(t *testing.T) {
+	loader := NewLoader("../tests")
+	standards, err := loader.LoadSuffixStandards("suffix_standards.json")
+	assert.NoError(t, err)
+	assert.Equal(t, suffixStandards, standards, "The shipped table should match the built-in one")
+
+	dir := t.TempDir()
+	yamlTable := "bv:\n  - besloten vennootschap\n  - b.v.\nnv:\n  - naamloze vennootschap\n"
+	assert.NoError(t, os.WriteFile(dir+"/nl.yaml", []byte(yamlTable), 0o600))
+	standards, err = NewLoader(dir).LoadSuffixStandards("nl.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, SuffixStandards{"bv": {"besloten vennootschap", "b.v."}, "nv": {"naamloze vennootschap"}}, standards)
+	assert.Equal(t, "acme bv", NewCompanyNameCleaner(standards).Clean("Acme Besloten Vennootschap"))
+
+	assert.NoError(t, os.WriteFile(dir+"/bad.json", []byte(`{"ltd": [""]}`), 0o600))
+	_, err = NewLoader(dir).LoadSuffixStandards("bad.json")
+	assert.Error(t, err, "An empty variant should be rejected")
+	_, err = NewLoader(dir).LoadSuffixStandards("nl.csv")
+	assert.Error(t, err)
+}
+
 func TestJsonLoader(t *testing.T) {
 	path, _ := os.Getwd()
 	loader := NewLoader(path)
@@ -152,3 +218,548 @@ func TestVectorizer(t *testing.T) {
 	assert.Equal(t, len(names), len(tfidfMatrix), "Expected 8000 names")
 
 }
+
+func TestFitAlphabet(t *testing.T) {
+	v := NewTfidfVectorizer(2, 1)
+	assert.NoError(t, v.FitAlphabet(DefaultAlphabet))
+	n := len(DefaultAlphabet)
+	assert.Equal(t, n*n, v.Vocabulary.Size())
+	assert.Equal(t, "aa", v.Vocabulary.Keys[0])
+	assert.Equal(t, "ab", v.Vocabulary.Keys[1])
+	assert.Equal(t, "  ", v.Vocabulary.Keys[n*n-1])
+
+	// Two parties building from the same alphabet agree on every index.
+	other := NewTfidfVectorizer(2, 1)
+	assert.NoError(t, other.FitAlphabet(DefaultAlphabet))
+	assert.Equal(t, v.Vocabulary.Keys, other.Vocabulary.Keys)
+	assert.Equal(t, v.Transform("acme co"), other.Transform("acme co"))
+
+	// Characters outside the alphabet are ignored.
+	vec := v.Transform("ab!")
+	idx, _ := v.Vocabulary.Get("ab")
+	assert.NotZero(t, vec[idx])
+
+	assert.Error(t, NewTfidfVectorizer(2, 1).FitAlphabet("abca"), "Repeated characters should be rejected")
+	assert.Error(t, NewTfidfVectorizer(2, 1).FitAlphabet(""), "Empty alphabet should be rejected")
+	assert.Error(t, NewTfidfVectorizer(4, 1).FitAlphabet(DefaultAlphabet), "37^4 features exceed the cap")
+}
+
+func TestHashingVectorizer(t *testing.T) {
+	seed := []byte("shared seed")
+	v, err := NewHashingVectorizer(2, 512, seed)
+	assert.NoError(t, err)
+	assert.Equal(t, 512, v.Size())
+
+	// Another party with the same seed gets the same vectors without any Fit.
+	other, err := NewHashingVectorizer(2, 512, seed)
+	assert.NoError(t, err)
+	assert.Equal(t, v.Transform("acme widgets"), other.Transform("acme widgets"))
+
+	keyed, err := NewHashingVectorizer(2, 512, []byte("another seed"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, v.Transform("acme widgets"), keyed.Transform("acme widgets"))
+
+	cosine := func(a, b []float64) float64 {
+		var dot, na, nb float64
+		for i := range a {
+			dot += a[i] * b[i]
+			na += a[i] * a[i]
+			nb += b[i] * b[i]
+		}
+		return dot / math.Sqrt(na*nb)
+	}
+	vectors := v.BatchTransform([]string{"stark industries", "stark industry", "wonka chocolate"})
+	assert.Equal(t, 3, len(vectors))
+	assert.Greater(t, cosine(vectors[0], vectors[1]), 0.8)
+	assert.Less(t, cosine(vectors[0], vectors[2]), 0.3)
+
+	_, err = NewHashingVectorizer(2, 1000, seed)
+	assert.Error(t, err, "Dimension must be a power of two")
+	_, err = NewHashingVectorizer(2, 512, nil)
+	assert.Error(t, err, "Seed must not be empty")
+}
+
+func TestTfidfWeighting(t *testing.T) {
+	// "ab" is in every document, "cd" in one of three.
+	v := NewTfidfVectorizer(2, 1)
+	v.NgramFunc = func(s string, n int) []string { return strings.Fields(s) }
+	v.Fit([]string{"ab cd", "ab ef", "ab ef"})
+	assert.Equal(t, []string{"ab", "cd", "ef"}, v.Vocabulary.Keys)
+	assert.Equal(t, []int{3, 1, 2}, v.DocFreq)
+	assert.Equal(t, 3, v.NumDocs)
+
+	ab, cd := 0, 1
+	assert.InDelta(t, math.Log(4.0/4.0)+1, v.IDF(ab), 1e-12, "Smooth IDF of an n-gram in every document")
+	assert.InDelta(t, math.Log(4.0/2.0)+1, v.IDF(cd), 1e-12)
+	assert.Greater(t, v.IDF(cd), v.IDF(ab), "Rare n-grams must weigh more")
+
+	v.SmoothIDF = false
+	assert.InDelta(t, 1.0, v.IDF(ab), 1e-12)
+	assert.InDelta(t, math.Log(3.0)+1, v.IDF(cd), 1e-12)
+
+	// TF is the count over the number of n-grams in the document.
+	vec := v.Transform("ab ab cd xx")
+	assert.InDelta(t, 2.0/4.0*v.IDF(ab), vec[ab], 1e-12)
+	assert.InDelta(t, 1.0/4.0*v.IDF(cd), vec[cd], 1e-12)
+
+	v.SublinearTF = true
+	vec = v.Transform("ab ab cd xx")
+	assert.InDelta(t, (1+math.Log(2))*v.IDF(ab), vec[ab], 1e-12)
+
+	v.Normalize = true
+	vec = v.Transform("ab ab cd xx")
+	var sum float64
+	for _, x := range vec {
+		sum += x * x
+	}
+	assert.InDelta(t, 1.0, sum, 1e-12, "Normalized vectors have unit norm")
+	assert.Equal(t, make([]float64, 3), v.Transform("zz"), "A vector without known n-grams stays zero")
+
+	// MinDF drops rare n-grams together with their frequencies.
+	v = NewTfidfVectorizer(2, 2)
+	v.NgramFunc = func(s string, n int) []string { return strings.Fields(s) }
+	v.Fit([]string{"ab cd", "ab ef", "ab ef"})
+	assert.Equal(t, []string{"ab", "ef"}, v.Vocabulary.Keys)
+	assert.Equal(t, []int{3, 2}, v.DocFreq)
+}
+
+func TestCalculateNGrams(t *testing.T) {
+	assert.Equal(t, []string{"ab", "bc"}, CalculateNGrams("abc", 2))
+	assert.Equal(t, []string{"ab", "bc"}, CalculateNGrams("a.b,c", 2), "Punctuation is stripped first")
+	assert.Empty(t, CalculateNGrams("a", 2))
+
+	// Multi-byte names are cut on rune boundaries.
+	assert.Equal(t, []string{"sp", "pó", "ół", "łk", "ka"}, CalculateNGrams("spółka", 2))
+	for _, ngram := range CalculateNGrams("Газпром 株式会社", 2) {
+		assert.True(t, utf8.ValidString(ngram), "Invalid UTF-8 in %q", ngram)
+		assert.Equal(t, 2, utf8.RuneCountInString(ngram))
+	}
+
+	assert.Equal(t, []string{" a", "ab", "b ", " c", "cd", "d "}, CalculatePaddedNGrams("ab  cd", 2))
+	assert.Equal(t, []string{" ab", "ab ", " x "}, CalculatePaddedNGrams("ab x", 3))
+	assert.Equal(t, []string{" x "}, CalculatePaddedNGrams("x", 4), "Short words are kept whole")
+	assert.Equal(t, []string{" ж", "жо", "ок", "к "}, CalculatePaddedNGrams("жок", 2))
+
+	// A vectorizer over a Cyrillic alphabet picks the n-grams up.
+	v := NewTfidfVectorizer(2, 1)
+	v.NgramFunc = CalculatePaddedNGrams
+	assert.NoError(t, v.FitAlphabet("абвгдежзийклмнопрстуфхцчшщъыьэюя "))
+	vec := v.Transform("газпром")
+	idx, ok := v.Vocabulary.Get("аз")
+	assert.True(t, ok)
+	assert.NotZero(t, vec[idx])
+}
+
+func TestNgramRangeAndAnalyzers(t *testing.T) {
+	_, err := NewTfidfVectorizerRange(AnalyzerChar, 3, 2, 1)
+	assert.Error(t, err, "An inverted range should be rejected")
+	_, err = NewTfidfVectorizerRange(Analyzer(9), 2, 4, 1)
+	assert.Error(t, err, "An unknown analyzer should be rejected")
+
+	assert.Equal(t, []string{"acme widgets", "widgets inc"}, CalculateWordNGrams("acme widgets inc", 2))
+
+	// A range cuts every length, shortest first.
+	v, err := NewTfidfVectorizerRange(AnalyzerChar, 2, 3, 1)
+	assert.NoError(t, err)
+	v.Fit([]string{"abc"})
+	assert.Equal(t, []string{"ab", "bc", "abc"}, v.Vocabulary.Keys)
+
+	// Words are marked so they never share a feature with an n-gram.
+	v, err = NewTfidfVectorizerRange(AnalyzerCombined, 2, 2, 1)
+	assert.NoError(t, err)
+	v.Fit([]string{"ab c"})
+	assert.Equal(t, []string{" a", "ab", "b ", " c", "c ", WordMarker + "ab", WordMarker + "c"}, v.Vocabulary.Keys)
+
+	v, err = NewTfidfVectorizerRange(AnalyzerWord, 1, 2, 1)
+	assert.NoError(t, err)
+	v.Fit([]string{"acme widgets", "acme"})
+	assert.Equal(t, []string{WordMarker + "acme", WordMarker + "widgets", WordMarker + "acme widgets"}, v.Vocabulary.Keys)
+	assert.Error(t, v.FitAlphabet(DefaultAlphabet), "Words have no alphabet vocabulary")
+
+	// Fitting the same corpus twice gives identical feature indexes.
+	corpus := []string{"acme widgets", "globex corporation", "initech", "acme holdings"}
+	a, _ := NewTfidfVectorizerRange(AnalyzerCombined, 2, 4, 1)
+	b, _ := NewTfidfVectorizerRange(AnalyzerCombined, 2, 4, 1)
+	a.Fit(corpus)
+	b.Fit(corpus)
+	assert.Equal(t, a.Vocabulary.Keys, b.Vocabulary.Keys)
+	assert.Equal(t, a.DocFreq, b.DocFreq)
+	assert.Equal(t, a.Transform("acme corp"), b.Transform("acme corp"))
+
+	// An alphabet range holds every length.
+	v, err = NewTfidfVectorizerRange(AnalyzerCharWB, 1, 2, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, v.FitAlphabet("ab "))
+	assert.Equal(t, 3+9, v.Vocabulary.Size())
+	assert.Equal(t, "a", v.Vocabulary.Keys[0])
+	assert.Equal(t, "aa", v.Vocabulary.Keys[3])
+}
+
+func TestSaveLoadVectorizer(t *testing.T) {
+	v, err := NewTfidfVectorizerRange(AnalyzerCombined, 2, 3, 1)
+	assert.NoError(t, err)
+	v.SublinearTF = true
+	v.Fit([]string{"acme widgets", "globex corporation", "acme holdings"})
+
+	var buf bytes.Buffer
+	assert.NoError(t, v.Save(&buf))
+	saved := buf.String()
+
+	var loaded TfidfVectorizer
+	assert.NoError(t, loaded.Load(strings.NewReader(saved)))
+	assert.Equal(t, v.Vocabulary.Keys, loaded.Vocabulary.Keys)
+	assert.Equal(t, v.DocFreq, loaded.DocFreq)
+	assert.Equal(t, v.Hash(), loaded.Hash())
+	assert.Equal(t, v.Transform("acme corp"), loaded.Transform("acme corp"))
+
+	// Saving again gives the same bytes.
+	buf.Reset()
+	assert.NoError(t, loaded.Save(&buf))
+	assert.Equal(t, saved, buf.String())
+
+	// Any change to the model changes its hash.
+	other, _ := NewTfidfVectorizerRange(AnalyzerCombined, 2, 3, 2)
+	other.Fit([]string{"acme widgets", "globex corporation", "acme holdings"})
+	assert.NotEqual(t, v.Hash(), other.Hash())
+
+	tampered := strings.Replace(saved, `"min_df":1`, `"min_df":2`, 1)
+	assert.True(t, errors.Is(loaded.Load(strings.NewReader(tampered)), ErrModelHash))
+	future := strings.Replace(saved, `"version":1`, `"version":2`, 1)
+	assert.True(t, errors.Is(loaded.Load(strings.NewReader(future)), ErrModelVersion))
+
+	// Document frequencies outside [1, NumDocs] would give infinite weights.
+	assert.Error(t, loaded.Load(strings.NewReader(strings.Replace(saved, `"num_docs":3`, `"num_docs":1`, 1))))
+	assert.Error(t, loaded.Load(strings.NewReader(strings.Replace(saved, `"doc_freq":[`, `"doc_freq":[0,`, 1))))
+}
+
+func TestTransformSparse(t *testing.T) {
+	v, err := NewTfidfVectorizerRange(AnalyzerCombined, 2, 3, 1)
+	assert.NoError(t, err)
+	v.Normalize = true
+	v.Fit([]string{"acme widgets", "globex corporation", "acme holdings"})
+
+	for _, name := range []string{"acme corp", "globex", "zzz"} {
+		sparse := v.TransformSparse(name)
+		assert.Equal(t, v.Transform(name), sparse.Dense(v.Size()))
+		for k := 1; k < len(sparse.Indices); k++ {
+			assert.Less(t, sparse.Indices[k-1], sparse.Indices[k], "Indices should be increasing")
+		}
+	}
+	assert.Empty(t, v.TransformSparse("zzz").Indices)
+	assert.Len(t, v.BatchTransformSparse([]string{"acme", "globex"}), 2)
+}
+
+func TestPhoneticEncoders(t *testing.T) {
+	for word, want := range map[string]string{
+		"Robert": "R163", "Rupert": "R163", "Ashcraft": "A261", "Tymczak": "T522", "Pfister": "P236", "A": "A000",
+	} {
+		assert.Equal(t, want, Soundex(word), word)
+	}
+	assert.Equal(t, "", Soundex("123"))
+
+	for _, tt := range []struct{ word, primary, secondary string }{
+		{"Smith", "SM0", "XMT"},
+		{"Schmidt", "XMT", "SMT"},
+		{"Michael", "MKL", "MXL"},
+		{"Jose", "HS", "HS"},
+		{"Knight", "NT", "NT"},
+	} {
+		primary, secondary := DoubleMetaphone(tt.word)
+		assert.Equal(t, tt.primary, primary, tt.word)
+		assert.Equal(t, tt.secondary, secondary, tt.word)
+	}
+
+	assert.Equal(t, "MAHANA", NYSIIS("Mohammed"))
+	assert.LessOrEqual(t, len(NYSIIS("Montgomerysmith")), 6)
+
+	// Spelling variants share codes under every encoder.
+	for _, p := range []Phonetic{PhoneticSoundex, PhoneticDoubleMetaphone, PhoneticNYSIIS} {
+		assert.Equal(t, p.Encode("mohammed"), p.Encode("muhammad"), p.String())
+	}
+	assert.Empty(t, PhoneticSoundex.Encode("42"))
+	assert.False(t, Phonetic(0).Valid())
+}
+
+func TestTransliteration(t *testing.T) {
+	assert.Equal(t, "gazprom", Transliterate("Газпром"))
+	assert.Equal(t, "moskva", Transliterate("Москва"))
+	assert.Equal(t, "athina", Transliterate("αθηνα"))
+	assert.Equal(t, "mhmd", Transliterate("محمد"))
+	assert.Equal(t, "acme 42", Transliterate("acme 42"))
+
+	cleaner := NewCompanyNameCleaner(SuffixStandards{"llc": {"ooo"}})
+	assert.Equal(t, "", cleaner.Clean("ООО Газпром"), "Non-Latin letters are removed without transliteration")
+	cleaner.Transliterate = true
+	assert.Equal(t, "llc gazprom", cleaner.Clean("ООО «Газпром»"))
+	assert.Equal(t, "athina", cleaner.Clean("Αθήνα"))
+	assert.Equal(t, "ouzo", cleaner.Clean("Ούζο"))
+
+	// Letters that carry a mark in Unicode keep their own transliteration,
+	// both composed and decomposed.
+	for letter, want := range map[string]string{"й": "y", "ё": "e", "ї": "yi", "ў": "u", "ѓ": "gj", "ќ": "kj"} {
+		assert.Equal(t, want, cleaner.Clean(letter), letter)
+		assert.Equal(t, want, cleaner.Clean(norm.NFD.String(letter)), "Decomposed %s", letter)
+	}
+	assert.Equal(t, "yuzhnyy", cleaner.Clean("Южный"))
+	assert.Equal(t, "kiyivstar", cleaner.Clean("Київстар"))
+
+	pipeline, err := NewPipeline(PipelineConfig{Steps: []StepConfig{{Step: StepTransliterate}, {Step: StepNormalize}}})
+	assert.NoError(t, err)
+	assert.Equal(t, "yuzhnyy", pipeline.Clean("Южный"))
+	_, err = NewPipeline(PipelineConfig{Steps: []StepConfig{{Step: StepNormalize}, {Step: StepTransliterate}}})
+	assert.Error(t, err, "Transliterating after normalizing loses letters")
+}
+
+func TestPhoneticFeatures(t *testing.T) {
+	corpus := []string{"mohammed trading", "muhammad trading", "acme widgets"}
+	plain := NewTfidfVectorizer(2, 1)
+	plain.Normalize = true
+	plain.Fit(corpus)
+	phonetic := NewTfidfVectorizer(2, 1)
+	phonetic.Normalize = true
+	phonetic.Phonetics = []Phonetic{PhoneticDoubleMetaphone, PhoneticNYSIIS}
+	phonetic.Fit(corpus)
+
+	_, ok := phonetic.Vocabulary.Get(WordMarker + "nysiis" + WordMarker + "MAHANA")
+	assert.True(t, ok, "Phonetic codes should be features")
+	cosine := func(v *TfidfVectorizer) float64 {
+		return utils.SparseDotProduct(v.TransformSparse("mohammed"), v.TransformSparse("muhammad"))
+	}
+	assert.Greater(t, cosine(phonetic), cosine(plain), "Phonetic codes should bring spelling variants closer")
+
+	assert.Error(t, phonetic.FitAlphabet(DefaultAlphabet))
+
+	// The encoders are part of the model.
+	var buf bytes.Buffer
+	assert.NoError(t, phonetic.Save(&buf))
+	var loaded TfidfVectorizer
+	assert.NoError(t, loaded.Load(&buf))
+	assert.Equal(t, phonetic.Phonetics, loaded.Phonetics)
+	assert.Equal(t, phonetic.Transform("muhammad"), loaded.Transform("muhammad"))
+	assert.NotEqual(t, plain.Hash(), phonetic.Hash())
+}
+
+func TestTokenPipeline(t *testing.T) {
+	nl, err := DefaultTokenRules("nl")
+	assert.NoError(t, err)
+	p := NewTokenPipeline(nl)
+	assert.Equal(t, "gebroeders zwinkels", p.Apply("gebr zwinkels bv"))
+	assert.Equal(t, "leliveld vastgoed", p.Apply("stichting leliveld vastgoed beheer"))
+	assert.Equal(t, "holding bv", p.Apply("holding bv"), "A name of stopwords only is kept")
+
+	sorted := NewTokenPipeline(nl.Merge(TokenRules{Sort: true, Abbreviations: map[string]string{"intl": "international"}}))
+	assert.Equal(t, sorted.Apply("bosch van den intl"), sorted.Apply("international van den bosch"))
+
+	_, err = DefaultTokenRules("xx")
+	assert.Error(t, err)
+
+	// The token step runs after suffixes, so a stopword they rewrite would
+	// never be dropped.
+	for _, language := range []string{"en", "nl", "de"} {
+		rules, _ := DefaultTokenRules(language)
+		for _, word := range rules.Stopwords {
+			assert.Equal(t, "acme "+word, DefaultPipeline().Clean("acme "+word), "Stopword %q of %s", word, language)
+		}
+	}
+
+	// The pipeline runs last in the cleaner.
+	cleaner := NewCompanyNameCleaner(SuffixStandards{"ltd": {"limited"}})
+	en, _ := DefaultTokenRules("en")
+	cleaner.Tokens = NewTokenPipeline(en)
+	assert.Equal(t, "acme international ltd", cleaner.Clean("The ACME Intl. Holdings Limited"))
+
+	dir := t.TempDir()
+	config := "abbreviations:\n  gebr: gebroeders\nstopwords: [bv]\nsort: true\n"
+	assert.NoError(t, os.WriteFile(dir+"/tokens.yml", []byte(config), 0o600))
+	rules, err := NewLoader(dir).LoadTokenRules("tokens.yml")
+	assert.NoError(t, err)
+	assert.Equal(t, TokenRules{Abbreviations: map[string]string{"gebr": "gebroeders"}, Stopwords: []string{"bv"}, Sort: true}, rules)
+	assert.Equal(t, "gebroeders zwinkels", NewTokenPipeline(rules).Apply("zwinkels gebr bv"))
+}
+
+func TestPipeline(t *testing.T) {
+	// The default pipeline cleans like CleanCompanyName.
+	pipeline := DefaultPipeline()
+	for _, name := range []string{"Bär-Hönig GmbH", "  ACME Pty. Ltd. ", "Société Générale S.A."} {
+		assert.Equal(t, CleanCompanyName(name), pipeline.Clean(name), name)
+	}
+	assert.Equal(t, "barhonig ltd", pipeline.Clean("Bär-Hönig GmbH"))
+
+	config := PipelineConfig{
+		Version: "nl-1",
+		Steps: []StepConfig{
+			{Step: StepNormalize},
+			{Step: StepPunctuation, Punctuation: PunctuationSpace},
+			{Step: StepSuffixes, Suffixes: SuffixStandards{"bv": {"besloten vennootschap"}}},
+			{Step: StepTokens, Language: "nl", Tokens: TokenRules{Sort: true}},
+		},
+	}
+	spaced, err := NewPipeline(config)
+	assert.NoError(t, err)
+	assert.Equal(t, "bar honig", spaced.Clean("Bär-Hönig Besloten Vennootschap"))
+	assert.Equal(t, "gebroeders zwinkels", spaced.Clean("Zwinkels, Gebr. BV"))
+	assert.Equal(t, "nl-1", spaced.Version())
+	assert.NotEqual(t, pipeline.Hash(), spaced.Hash())
+
+	// The same steps give the same hash; a changed step does not.
+	again, err := NewPipeline(config)
+	assert.NoError(t, err)
+	assert.Equal(t, spaced.ID(), again.ID())
+	config.Steps[1].Punctuation = PunctuationDelete
+	changed, err := NewPipeline(config)
+	assert.NoError(t, err)
+	assert.NotEqual(t, spaced.Hash(), changed.Hash())
+
+	// Steps compose in code, too.
+	chain := Chain{Normalize, Punctuation(PunctuationSpace), NewTokenPipeline(TokenRules{Sort: true})}
+	assert.Equal(t, "bar honig", chain.Clean("Hönig-Bär"))
+
+	_, err = NewPipeline(PipelineConfig{Steps: []StepConfig{{Step: "stem"}}})
+	assert.Error(t, err)
+	_, err = NewPipeline(PipelineConfig{Steps: []StepConfig{{Step: StepTokens, Language: "xx"}}})
+	assert.Error(t, err)
+
+	dir := t.TempDir()
+	yml := "version: v2\nsteps:\n  - step: normalize\n  - step: punctuation\n    punctuation: space\n  - step: suffixes\n"
+	assert.NoError(t, os.WriteFile(dir+"/pipeline.yml", []byte(yml), 0o600))
+	loaded, err := NewLoader(dir).LoadPipelineConfig("pipeline.yml")
+	assert.NoError(t, err)
+	assert.Equal(t, PunctuationSpace, loaded.Steps[1].Punctuation)
+	fromYAML, err := NewPipeline(loaded)
+	assert.NoError(t, err)
+	assert.Equal(t, "bar honig ltd", fromYAML.Clean("Bär-Hönig GmbH"))
+
+	assert.NoError(t, os.WriteFile(dir+"/bad.yml", []byte("steps:\n  - step: punctuation\n    punctuation: drop\n"), 0o600))
+	_, err = NewLoader(dir).LoadPipelineConfig("bad.yml")
+	assert.Error(t, err)
+}
+
+func TestEntityVectorizer(t *testing.T) {
+	entities := []Entity{
+		{Name: "Acme Holdings Ltd", Address: "1 Main Street, Springfield", Country: "United States", RegistryID: "US-1234567"},
+		{Name: "Initech LLC", Address: "4120 Freidrich Lane, Austin", Country: "United States", RegistryID: "US-7654321"},
+		{Name: "Zwinkels B.V.", Address: "Dorpsstraat 12, Naaldwijk", Country: "Netherlands", RegistryID: "NL 27.12.34.56"},
+	}
+	v := DefaultEntityVectorizer()
+	v.Fit(entities)
+	assert.Equal(t, v.Size(), len(v.Weights()))
+	assert.Equal(t, v.Size(), len(v.Transform(entities[0])))
+
+	// The dot product of two entity vectors sums the per-field similarities,
+	// and weighting one side gives the weighted score.
+	query := Entity{Name: "ACME holdings limited", Address: "1 Main St Springfield", Country: "united states", RegistryID: "us1234567"}
+	sims, score := v.FieldSimilarities(query, entities[0])
+	assert.Len(t, sims, 4)
+	assert.InDelta(t, 1.0, sims[3], 1e-9, "Registry IDs match after cleaning")
+	weights := v.Weights()
+	a, b := v.Transform(query), v.Transform(entities[0])
+	var plain, weighted float64
+	for k := range a {
+		plain += a[k] * b[k]
+		weighted += a[k] * b[k] * weights[k]
+	}
+	var sum float64
+	for _, s := range sims {
+		sum += s
+	}
+	assert.InDelta(t, sum, plain, 1e-9)
+	assert.InDelta(t, score, weighted, 1e-9)
+	_, other := v.FieldSimilarities(query, entities[2])
+	assert.Greater(t, score, other)
+
+	// A missing field adds nothing.
+	sims, _ = v.FieldSimilarities(Entity{Name: "Acme"}, entities[0])
+	assert.Equal(t, 0.0, sims[1])
+
+	_, err := NewEntityVectorizer(FieldModel{Field: FieldName, Cleaner: DefaultPipeline()})
+	assert.Error(t, err)
+	name := FieldModel{Field: FieldName, Cleaner: DefaultPipeline(), Vectorizer: NewTfidfVectorizer(2, 1), Weight: 1}
+	_, err = NewEntityVectorizer(name, name)
+	assert.Error(t, err)
+}
+
+func TestLoadEntities(t *testing.T) {
+	dir := t.TempDir()
+	csvData := "id,Name,country,registry_id\n1,Acme Ltd,GB,\"01234567\"\n2,\"Initech, LLC\",US,\n"
+	assert.NoError(t, os.WriteFile(dir+"/entities.csv", []byte(csvData), 0o600))
+	jsonData := `[{"name": "Acme Ltd", "country": "GB", "registry_id": "01234567"}, {"name": "Initech, LLC", "country": "US"}]`
+	assert.NoError(t, os.WriteFile(dir+"/entities.json", []byte(jsonData), 0o600))
+
+	want := []Entity{
+		{Name: "Acme Ltd", Country: "GB", RegistryID: "01234567"},
+		{Name: "Initech, LLC", Country: "US"},
+	}
+	loader := NewLoader(dir)
+	for _, file := range []string{"entities.csv", "entities.json"} {
+		entities, err := loader.LoadEntities(file)
+		assert.NoError(t, err, file)
+		assert.Equal(t, want, entities, file)
+	}
+
+	assert.NoError(t, os.WriteFile(dir+"/nameless.csv", []byte("address\nMain Street\n"), 0o600))
+	_, err := loader.LoadEntities("nameless.csv")
+	assert.Error(t, err)
+}
+
+func TestLoaderFormats(t *testing.T) {
+	assert.Equal(t, FormatCSV, FormatOf("export.CSV.gz"))
+	assert.Equal(t, FormatJSONL, FormatOf("names.ndjson.zst"))
+	assert.Equal(t, FormatJSON, FormatOf("names_train.json"))
+	assert.Equal(t, FormatText, FormatOf("names.gz"))
+
+	want := []string{"Acme; Ltd", "Initech LLC"}
+	loader := NewLoader(t.TempDir())
+	loader.CSV = CSVOptions{Delimiter: ';', Column: "company"}
+	csvData := "id;company\n1;\"Acme; Ltd\"\n2;Initech LLC\n"
+	names, err := loader.ReadNames(strings.NewReader(csvData), FormatCSV)
+	assert.NoError(t, err)
+	assert.Equal(t, want, names)
+
+	// Without a header, names come from ColumnIndex.
+	byIndex := NewLoader("")
+	byIndex.CSV = CSVOptions{ColumnIndex: 1}
+	names, err = byIndex.ReadNames(strings.NewReader("1,Acme Ltd\n2,Initech LLC,extra\n"), FormatCSV)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Acme Ltd", "Initech LLC"}, names)
+
+	// A record too short for the column is an error, not a lost name.
+	_, err = byIndex.ReadNames(strings.NewReader("1,Acme Ltd\n2\n3,Globex\n"), FormatCSV)
+	assert.ErrorContains(t, err, "record 2 (line 2)")
+	_, err = loader.ReadNames(strings.NewReader(csvData+"3\n"), FormatCSV)
+	assert.ErrorContains(t, err, "record 4 (line 4)")
+
+	byIndex.CSV.ColumnIndex = -1
+	_, err = byIndex.ReadNames(strings.NewReader("1,Acme Ltd\n"), FormatCSV)
+	assert.Error(t, err, "Negative column index")
+
+	loader.CSV.Column = "name"
+	_, err = loader.ReadNames(strings.NewReader(csvData), FormatCSV)
+	assert.Error(t, err, "Missing column")
+
+	names, err = loader.ReadNames(strings.NewReader("\"Acme; Ltd\"\n\n{\"name\": \"Initech LLC\", \"country\": \"US\"}\n"), FormatJSONL)
+	assert.NoError(t, err)
+	assert.Equal(t, want, names)
+	_, err = loader.ReadNames(strings.NewReader("\"Acme\"\nnot json\n"), FormatJSONL)
+	assert.ErrorContains(t, err, "line 2")
+	_, err = loader.ReadNames(strings.NewReader("{\"name\": \"Acme\"}\n{\"country\": \"US\"}\n"), FormatJSONL)
+	assert.ErrorContains(t, err, "line 2")
+
+	// Compressed input is detected from its content.
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte("Acme; Ltd\nInitech LLC\n"))
+	gw.Close()
+	assert.NoError(t, os.WriteFile(filepath.Join(loader.basePath, "names.txt.gz"), gz.Bytes(), 0o600))
+	names, err = loader.LoadNames("names.txt.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, want, names)
+
+	var zst bytes.Buffer
+	zw, err := zstd.NewWriter(&zst)
+	assert.NoError(t, err)
+	zw.Write([]byte(`{"name": "Acme Ltd", "registry_id": "01234567"}` + "\n" + `{"name": "Initech LLC", "country": "US"}` + "\n"))
+	zw.Close()
+	entities, err := loader.ReadEntities(&zst, FormatJSONL)
+	assert.NoError(t, err)
+	assert.Equal(t, []Entity{{Name: "Acme Ltd", RegistryID: "01234567"}, {Name: "Initech LLC", Country: "US"}}, entities)
+}
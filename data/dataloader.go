@@ -2,15 +2,91 @@ package data
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
 	"encoding/json"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"gopkg.in/yaml.v3"
 )
 
-// LoadNames loads names from names_train.json into a string slice
+// Format is the layout of a file of names or entities.
+type Format int
+
+const (
+	// FormatText holds one name per line.
+	FormatText Format = iota
+	// FormatJSON holds a JSON array of names for ReadNames, or of entity
+	// objects for ReadEntities.
+	FormatJSON
+	// FormatJSONL holds one JSON value per line: an object with a "name" and
+	// the other fields of an Entity, or for ReadNames also just a name. Blank
+	// lines are skipped.
+	FormatJSONL
+	// FormatCSV holds delimited records, see CSVOptions.
+	FormatCSV
+)
 
+func (f Format) String() string {
+	switch f {
+	case FormatText:
+		return "text"
+	case FormatJSON:
+		return "json"
+	case FormatJSONL:
+		return "jsonl"
+	case FormatCSV:
+		return "csv"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// FormatOf returns the format of fileName by its extension, ignoring a .gz,
+// .zst or .zstd suffix: .json, .jsonl or .ndjson, .csv, and text otherwise.
+func FormatOf(fileName string) Format {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	switch ext {
+	case ".gz", ".zst", ".zstd":
+		ext = strings.ToLower(filepath.Ext(strings.TrimSuffix(fileName, filepath.Ext(fileName))))
+	}
+	switch ext {
+	case ".json":
+		return FormatJSON
+	case ".jsonl", ".ndjson":
+		return FormatJSONL
+	case ".csv":
+		return FormatCSV
+	}
+	return FormatText
+}
+
+// CSVOptions configures how a Loader reads CSV.
+type CSVOptions struct {
+	// Delimiter separates fields; 0 means a comma.
+	Delimiter rune
+	// Header tells that the first record names the columns. Entities always
+	// need one.
+	Header bool
+	// Column names the column holding the names, which implies Header. If
+	// empty, names are read from column ColumnIndex.
+	Column      string
+	ColumnIndex int
+}
+
+// Loader reads names, entities and configuration files from a directory.
+// Names and entities may be gzip or zstd compressed, which is detected from
+// the content rather than the file name.
 type Loader struct {
 	basePath string
+	// CSV configures the reading of FormatCSV.
+	CSV CSVOptions
 }
 
 // NewLoader creates a new Loader instance
@@ -18,49 +94,315 @@ func NewLoader(basePath string) *Loader {
 	return &Loader{basePath: basePath}
 }
 
-func _load_json_file(path string) ([]string, error) {
-
-	file, err := os.Open(path)
+// LoadNames loads the names of fileName in the format FormatOf finds.
+func (l *Loader) LoadNames(fileName string) ([]string, error) {
+	file, err := os.Open(filepath.Join(l.basePath, fileName))
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
+	names, err := l.ReadNames(file, FormatOf(fileName))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return names, nil
+}
 
-	var names []string
-	if err := json.NewDecoder(file).Decode(&names); err != nil {
+// ReadNames reads names in format from r, which may be compressed.
+func (l *Loader) ReadNames(r io.Reader, format Format) ([]string, error) {
+	r, closeReader, err := decompress(r)
+	if err != nil {
 		return nil, err
 	}
+	defer closeReader()
 
+	var names []string
+	switch format {
+	case FormatText:
+		err = scanLines(r, func(line string) error {
+			names = append(names, line)
+			return nil
+		})
+	case FormatJSON:
+		err = json.NewDecoder(r).Decode(&names)
+	case FormatJSONL:
+		err = scanLines(r, func(line string) error {
+			if strings.TrimSpace(line) == "" {
+				return nil
+			}
+			if strings.HasPrefix(strings.TrimSpace(line), "{") {
+				var e struct {
+					Name *string `json:"name"`
+				}
+				if err := json.Unmarshal([]byte(line), &e); err != nil {
+					return err
+				}
+				if e.Name == nil {
+					return fmt.Errorf("object without a %q field", FieldName)
+				}
+				names = append(names, *e.Name)
+				return nil
+			}
+			var name string
+			err := json.Unmarshal([]byte(line), &name)
+			names = append(names, name)
+			return err
+		})
+	case FormatCSV:
+		if l.CSV.Column == "" && l.CSV.ColumnIndex < 0 {
+			return nil, fmt.Errorf("negative CSV column index %d", l.CSV.ColumnIndex)
+		}
+		err = l.readCSV(r, l.CSV.Header || l.CSV.Column != "", func(header []string) (func([]string) error, error) {
+			column := l.CSV.ColumnIndex
+			if l.CSV.Column != "" {
+				column = slices.IndexFunc(header, func(name string) bool {
+					return strings.EqualFold(strings.TrimSpace(name), l.CSV.Column)
+				})
+				if column < 0 {
+					return nil, fmt.Errorf("no %q column", l.CSV.Column)
+				}
+			}
+			return func(record []string) error {
+				if column >= len(record) {
+					return fmt.Errorf("%d fields, no column %d", len(record), column)
+				}
+				names = append(names, record[column])
+				return nil
+			}, nil
+		})
+	default:
+		return nil, fmt.Errorf("unknown format %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
 	return names, nil
 }
 
-func _load_txt_file(path string) ([]string, error) {
-
-	file, err := os.Open(path)
+// LoadEntities loads entity records from fileName: a .json, .yaml or .yml
+// list of objects, JSON Lines, or CSV whose header names the columns "name"
+// and any of "address", "country" and "registry_id". Other columns are
+// ignored.
+func (l *Loader) LoadEntities(fileName string) ([]Entity, error) {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		var entities []Entity
+		if err := l.loadConfig(fileName, &entities); err != nil {
+			return nil, err
+		}
+		return entities, nil
+	}
+	file, err := os.Open(filepath.Join(l.basePath, fileName))
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
+	entities, err := l.ReadEntities(file, FormatOf(fileName))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return entities, nil
+}
 
-	var names []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		names = append(names, scanner.Text())
+// ReadEntities reads entities in format from r, which may be compressed. In
+// FormatText every line is the name of an entity.
+func (l *Loader) ReadEntities(r io.Reader, format Format) ([]Entity, error) {
+	r, closeReader, err := decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	defer closeReader()
+
+	var entities []Entity
+	switch format {
+	case FormatText:
+		err = scanLines(r, func(line string) error {
+			entities = append(entities, Entity{Name: line})
+			return nil
+		})
+	case FormatJSON:
+		err = json.NewDecoder(r).Decode(&entities)
+	case FormatJSONL:
+		err = scanLines(r, func(line string) error {
+			if strings.TrimSpace(line) == "" {
+				return nil
+			}
+			var e Entity
+			err := json.Unmarshal([]byte(line), &e)
+			entities = append(entities, e)
+			return err
+		})
+	case FormatCSV:
+		err = l.readCSV(r, true, func(header []string) (func([]string) error, error) {
+			columns := make(map[Field]int)
+			for i, column := range header {
+				for _, f := range []Field{FieldName, FieldAddress, FieldCountry, FieldRegistryID} {
+					if strings.EqualFold(strings.TrimSpace(column), f.String()) {
+						columns[f] = i
+					}
+				}
+			}
+			if _, ok := columns[FieldName]; !ok {
+				return nil, fmt.Errorf("no %q column", FieldName)
+			}
+			return func(record []string) error {
+				var values [4]string
+				for f, i := range columns {
+					if i < len(record) {
+						values[f] = record[i]
+					}
+				}
+				entities = append(entities, Entity{Name: values[FieldName], Address: values[FieldAddress], Country: values[FieldCountry], RegistryID: values[FieldRegistryID]})
+				return nil
+			}, nil
+		})
+	default:
+		return nil, fmt.Errorf("unknown format %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entities, nil
+}
+
+// readCSV reads the records of r one at a time. start is called once with
+// the first record if hasHeader, or nil, and returns the function every
+// following record is passed to. An error of that function is reported with
+// the number of the record, counting the header, and its line.
+func (l *Loader) readCSV(r io.Reader, hasHeader bool, start func(header []string) (func([]string) error, error)) error {
+	reader := csv.NewReader(r)
+	reader.Comma = ','
+	if l.CSV.Delimiter != 0 {
+		reader.Comma = l.CSV.Delimiter
+	}
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	var header []string
+	if hasHeader {
+		record, err := reader.Read()
+		if err != nil {
+			return fmt.Errorf("reading header: %w", err)
+		}
+		header = slices.Clone(record)
+	}
+	add, err := start(header)
+	if err != nil {
+		return err
+	}
+	n := 0
+	if hasHeader {
+		n = 1
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n++
+		if err := add(record); err != nil {
+			line, _ := reader.FieldPos(0)
+			return fmt.Errorf("record %d (line %d): %w", n, line, err)
+		}
+	}
+}
+
+// maxLineLength bounds the lines of text and JSON Lines input.
+const maxLineLength = 1 << 20
+
+// scanLines passes every line of r to add.
+func scanLines(r io.Reader, add func(line string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineLength)
+	for line := 1; scanner.Scan(); line++ {
+		if err := add(scanner.Text()); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
 	}
+	return scanner.Err()
+}
+
+// Magic numbers of the compressed formats decompress detects.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
 
-	if err := scanner.Err(); err != nil {
+// decompress returns a reader of the decompressed content of r if it starts
+// with the magic number of gzip or zstd, and of r itself otherwise, together
+// with the function that releases the decompressor.
+func decompress(r io.Reader) (io.Reader, func(), error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gz, func() { gz.Close() }, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	}
+	return buffered, func() {}, nil
+}
+
+// LoadSuffixStandards loads a suffix standards table from a .json, .yaml or
+// .yml file mapping every standard to its variants.
+func (l *Loader) LoadSuffixStandards(fileName string) (SuffixStandards, error) {
+	var standards SuffixStandards
+	if err := l.loadConfig(fileName, &standards); err != nil {
 		return nil, err
 	}
+	if err := standards.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return standards, nil
+}
 
-	return names, nil
+// LoadTokenRules loads the rules of a TokenPipeline from a .json, .yaml or
+// .yml file with "abbreviations", "stopwords" and "sort" keys.
+func (l *Loader) LoadTokenRules(fileName string) (TokenRules, error) {
+	var rules TokenRules
+	err := l.loadConfig(fileName, &rules)
+	return rules, err
 }
 
-func (l *Loader) LoadNames(fileName string) ([]string, error) {
-	// if path ends in .json, load json file
+// LoadPipelineConfig loads the definition of a cleaning Pipeline from a
+// .json, .yaml or .yml file with a "version" and a list of "steps".
+func (l *Loader) LoadPipelineConfig(fileName string) (PipelineConfig, error) {
+	var config PipelineConfig
+	err := l.loadConfig(fileName, &config)
+	return config, err
+}
+
+// loadConfig decodes a JSON or YAML file into v, by its extension.
+func (l *Loader) loadConfig(fileName string, v any) error {
 	filePath := filepath.Join(l.basePath, fileName)
-	if filepath.Ext(filePath) == ".json" {
-		return _load_json_file(filePath)
-	} else {
-		return _load_txt_file(filePath)
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	switch filepath.Ext(filePath) {
+	case ".json":
+		err = json.Unmarshal(content, v)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, v)
+	default:
+		return fmt.Errorf("unknown config format %q", filepath.Ext(filePath))
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", fileName, err)
 	}
+	return nil
 }
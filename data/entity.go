@@ -0,0 +1,195 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/utils"
+)
+
+// Entity is a structured record to match, as found in KYC and AML lists.
+// Only Name is required; an empty field adds nothing to a score.
+type Entity struct {
+	Name       string `json:"name" yaml:"name"`
+	Address    string `json:"address,omitempty" yaml:"address,omitempty"`
+	Country    string `json:"country,omitempty" yaml:"country,omitempty"`
+	RegistryID string `json:"registry_id,omitempty" yaml:"registry_id,omitempty"`
+}
+
+// Field names one field of an Entity.
+type Field int
+
+const (
+	FieldName Field = iota
+	FieldAddress
+	FieldCountry
+	FieldRegistryID
+)
+
+func (f Field) String() string {
+	switch f {
+	case FieldName:
+		return "name"
+	case FieldAddress:
+		return "address"
+	case FieldCountry:
+		return "country"
+	case FieldRegistryID:
+		return "registry_id"
+	}
+	return fmt.Sprintf("Field(%d)", int(f))
+}
+
+// Get returns field f of e.
+func (e Entity) Get(f Field) string {
+	switch f {
+	case FieldName:
+		return e.Name
+	case FieldAddress:
+		return e.Address
+	case FieldCountry:
+		return e.Country
+	case FieldRegistryID:
+		return e.RegistryID
+	}
+	return ""
+}
+
+// FieldModel cleans and vectorizes one field of an Entity, and weighs its
+// similarity in the score of two entities.
+type FieldModel struct {
+	Field      Field
+	Cleaner    Cleaner
+	Vectorizer *TfidfVectorizer
+	Weight     float64
+}
+
+// EntityVectorizer turns an Entity into one vector: the unit-length vector of
+// each field, one after the other. The dot product of two such vectors is
+// the sum of the per-field cosine similarities, and with Weights applied to
+// one side, as hem.EvaluatorContext does, their weighted sum.
+type EntityVectorizer struct {
+	Fields []FieldModel
+}
+
+// NewEntityVectorizer creates a vectorizer over fields. Every field must have
+// a cleaner and a vectorizer and appear once.
+func NewEntityVectorizer(fields ...FieldModel) (*EntityVectorizer, error) {
+	seen := make(map[Field]bool)
+	for _, f := range fields {
+		if f.Cleaner == nil || f.Vectorizer == nil {
+			return nil, fmt.Errorf("field %s needs a cleaner and a vectorizer", f.Field)
+		}
+		if f.Weight < 0 {
+			return nil, fmt.Errorf("negative weight %g for field %s", f.Weight, f.Field)
+		}
+		if seen[f.Field] {
+			return nil, fmt.Errorf("field %s appears twice", f.Field)
+		}
+		seen[f.Field] = true
+	}
+	return &EntityVectorizer{Fields: fields}, nil
+}
+
+// registryID keeps only the letters and digits of a registration number, so
+// that "NL 12.34.56" and "nl123456" are the same.
+var registryID = CleanerFunc(func(id string) string {
+	return strings.ReplaceAll(removePunctuation(normalizeString(id)), " ", "")
+})
+
+// DefaultEntityVectorizer returns the unfitted vectorizer for all four
+// fields: names cleaned by DefaultPipeline, character 2-grams for names and
+// registration numbers, 3-grams within words for addresses and whole words
+// for countries. The weights add up to 1, so scores stay within [0, 1].
+func DefaultEntityVectorizer() *EntityVectorizer {
+	address, _ := NewTfidfVectorizerRange(AnalyzerCharWB, 3, 3, 1)
+	country, _ := NewTfidfVectorizerRange(AnalyzerWord, 1, 1, 1)
+	return &EntityVectorizer{Fields: []FieldModel{
+		{Field: FieldName, Cleaner: DefaultPipeline(), Vectorizer: NewTfidfVectorizer(2, 1), Weight: 0.5},
+		{Field: FieldAddress, Cleaner: Chain{Normalize, Punctuation(PunctuationSpace)}, Vectorizer: address, Weight: 0.25},
+		{Field: FieldCountry, Cleaner: Chain{Normalize, Punctuation(PunctuationDelete)}, Vectorizer: country, Weight: 0.1},
+		{Field: FieldRegistryID, Cleaner: registryID, Vectorizer: NewTfidfVectorizer(2, 1), Weight: 0.15},
+	}}
+}
+
+// Fit fits the vectorizer of every field on the cleaned values of entities.
+func (v *EntityVectorizer) Fit(entities []Entity) {
+	for _, f := range v.Fields {
+		values := make([]string, 0, len(entities))
+		for _, e := range entities {
+			if value := f.Cleaner.Clean(e.Get(f.Field)); value != "" {
+				values = append(values, value)
+			}
+		}
+		f.Vectorizer.Fit(values)
+	}
+}
+
+// Size returns the vector length, the sum of the field vocabulary sizes.
+func (v *EntityVectorizer) Size() int {
+	size := 0
+	for _, f := range v.Fields {
+		size += f.Vectorizer.Size()
+	}
+	return size
+}
+
+// Weights returns the weight of every slot of a vector, for
+// hem.EvaluatorContext.Weights.
+func (v *EntityVectorizer) Weights() []float64 {
+	weights := make([]float64, 0, v.Size())
+	for _, f := range v.Fields {
+		for range f.Vectorizer.Size() {
+			weights = append(weights, f.Weight)
+		}
+	}
+	return weights
+}
+
+// TransformSparse cleans, vectorizes and normalizes every field of e and
+// concatenates the results.
+func (v *EntityVectorizer) TransformSparse(e Entity) utils.SparseVector {
+	var vector utils.SparseVector
+	offset := 0
+	for _, f := range v.Fields {
+		field := f.Vectorizer.TransformSparse(f.Cleaner.Clean(e.Get(f.Field)))
+		utils.NormalizeSparse(field)
+		for k, i := range field.Indices {
+			vector.Indices = append(vector.Indices, offset+i)
+			vector.Values = append(vector.Values, field.Values[k])
+		}
+		offset += f.Vectorizer.Size()
+	}
+	return vector
+}
+
+// Transform returns the dense form of TransformSparse.
+func (v *EntityVectorizer) Transform(e Entity) []float64 {
+	return v.TransformSparse(e).Dense(v.Size())
+}
+
+// BatchTransform converts a batch of entities into dense vectors.
+func (v *EntityVectorizer) BatchTransform(entities []Entity) [][]float64 {
+	vectors := make([][]float64, len(entities))
+	for i, e := range entities {
+		vectors[i] = v.Transform(e)
+	}
+	return vectors
+}
+
+// FieldSimilarities returns the cosine similarity of a and b per field, in
+// the order of Fields, and their weighted sum, which is what the encrypted
+// score of a against b decrypts to.
+func (v *EntityVectorizer) FieldSimilarities(a, b Entity) ([]float64, float64) {
+	sims := make([]float64, len(v.Fields))
+	var total float64
+	for i, f := range v.Fields {
+		va := f.Vectorizer.TransformSparse(f.Cleaner.Clean(a.Get(f.Field)))
+		vb := f.Vectorizer.TransformSparse(f.Cleaner.Clean(b.Get(f.Field)))
+		utils.NormalizeSparse(va)
+		utils.NormalizeSparse(vb)
+		sims[i] = utils.SparseDotProduct(va, vb)
+		total += f.Weight * sims[i]
+	}
+	return sims, total
+}
@@ -0,0 +1,92 @@
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Vectorizer turns names into fixed-length vectors ready for BatchEncrypt.
+type Vectorizer interface {
+	Transform(text string) []float64
+	BatchTransform(data []string) [][]float64
+	// Size is the length of every vector Transform returns.
+	Size() int
+}
+
+var (
+	_ Vectorizer = (*TfidfVectorizer)(nil)
+	_ Vectorizer = (*HashingVectorizer)(nil)
+)
+
+// HashingVectorizer maps n-grams straight to one of Dimension features with a
+// keyed hash, so it needs no Fit and its feature indexes never depend on a
+// corpus. Parties that share the seed vectorize independently and still get
+// comparable vectors. A second hash bit picks the sign each n-gram adds with,
+// so that colliding n-grams cancel out in expectation instead of piling up.
+type HashingVectorizer struct {
+	NgramFunc   func(string, int) []string
+	NgramLength int
+	Dimension   int
+	key         []byte
+}
+
+// NewHashingVectorizer creates a hashing vectorizer over ngramLength-grams.
+// dimension must be a power of two, so that it fills the slots of an HE ring
+// exactly, e.g. 512 or 1024. seed keys the hash and must be the same on both
+// sides.
+func NewHashingVectorizer(ngramLength, dimension int, seed []byte) (*HashingVectorizer, error) {
+	if ngramLength < 1 {
+		return nil, fmt.Errorf("n-gram length must be positive, got %d", ngramLength)
+	}
+	if dimension < 1 || dimension&(dimension-1) != 0 {
+		return nil, fmt.Errorf("dimension must be a power of two, got %d", dimension)
+	}
+	if len(seed) == 0 {
+		return nil, fmt.Errorf("empty hashing seed")
+	}
+	return &HashingVectorizer{
+		NgramFunc:   CalculateNGrams,
+		NgramLength: ngramLength,
+		Dimension:   dimension,
+		key:         append([]byte(nil), seed...),
+	}, nil
+}
+
+// Size returns the vector length, Dimension.
+func (v *HashingVectorizer) Size() int {
+	return v.Dimension
+}
+
+// feature returns the index and sign an n-gram contributes to.
+func (v *HashingVectorizer) feature(ngram string) (int, float64) {
+	mac := hmac.New(sha256.New, v.key)
+	mac.Write([]byte(ngram))
+	sum := mac.Sum(nil)
+	index := int(binary.BigEndian.Uint64(sum) & uint64(v.Dimension-1))
+	if sum[8]&1 == 1 {
+		return index, -1
+	}
+	return index, 1
+}
+
+// Transform returns the signed n-gram counts of text folded into Dimension
+// features.
+func (v *HashingVectorizer) Transform(text string) []float64 {
+	vector := make([]float64, v.Dimension)
+	for _, ngram := range v.NgramFunc(text, v.NgramLength) {
+		index, sign := v.feature(ngram)
+		vector[index] += sign
+	}
+	return vector
+}
+
+// BatchTransform converts a batch of text into hashed vectors.
+func (v *HashingVectorizer) BatchTransform(data []string) [][]float64 {
+	matrix := make([][]float64, len(data))
+	for i, text := range data {
+		matrix[i] = v.Transform(text)
+	}
+	return matrix
+}
@@ -0,0 +1,157 @@
+package data
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// ModelVersion is the version Save writes. Load rejects any other version.
+const ModelVersion = 1
+
+var (
+	ErrModelVersion = errors.New("data: unsupported model version")
+	ErrModelHash    = errors.New("data: model hash mismatch")
+)
+
+// savedModel is the JSON form of a fitted TfidfVectorizer.
+type savedModel struct {
+	Version        int        `json:"version"`
+	Hash           string     `json:"hash"`
+	Analyzer       Analyzer   `json:"analyzer"`
+	NgramLength    int        `json:"ngram_length"`
+	MaxNgramLength int        `json:"max_ngram_length"`
+	MinDF          int        `json:"min_df"`
+	Phonetics      []Phonetic `json:"phonetics,omitempty"`
+	Alphabet       string     `json:"alphabet,omitempty"`
+	Vocabulary     []string   `json:"vocabulary"`
+	DocFreq        []int      `json:"doc_freq,omitempty"`
+	NumDocs        int        `json:"num_docs"`
+	SmoothIDF      bool       `json:"smooth_idf"`
+	SublinearTF    bool       `json:"sublinear_tf"`
+	Normalize      bool       `json:"normalize"`
+}
+
+// Hash returns the SHA-256 of everything that decides the vectors Transform
+// returns: the analyzer, the n-gram range, MinDF, the phonetic encoders, the
+// alphabet, the vocabulary in order, the IDF statistics and the weighting
+// options. Two vectorizers with the same hash give the same vector for every
+// name, as long as neither replaced the NgramFunc its analyzer comes with.
+func (v *TfidfVectorizer) Hash() [sha256.Size]byte {
+	h := sha256.New()
+	minN, maxN := v.NgramRange()
+	for _, x := range []int{int(v.Analyzer), minN, maxN, v.MinDF} {
+		hashUint(h, x)
+	}
+	hashUint(h, len(v.Phonetics))
+	for _, p := range v.Phonetics {
+		hashUint(h, int(p))
+	}
+	hashString(h, v.Alphabet)
+	hashUint(h, v.Vocabulary.Size())
+	for _, term := range v.Vocabulary.Keys {
+		hashString(h, term)
+	}
+	hashUint(h, len(v.DocFreq))
+	for _, df := range v.DocFreq {
+		hashUint(h, df)
+	}
+	hashUint(h, v.NumDocs)
+	for _, option := range []bool{v.SmoothIDF, v.SublinearTF, v.Normalize} {
+		if option {
+			h.Write([]byte{1})
+		} else {
+			h.Write([]byte{0})
+		}
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+func hashUint(h hash.Hash, x int) {
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(x)))
+}
+
+func hashString(h hash.Hash, s string) {
+	hashUint(h, len(s))
+	io.WriteString(h, s)
+}
+
+// Save writes the fitted vectorizer as versioned JSON, together with its Hash,
+// so that it can be loaded instead of refitted.
+func (v *TfidfVectorizer) Save(w io.Writer) error {
+	sum := v.Hash()
+	minN, maxN := v.NgramRange()
+	model := savedModel{
+		Version:        ModelVersion,
+		Hash:           hex.EncodeToString(sum[:]),
+		Analyzer:       v.Analyzer,
+		NgramLength:    minN,
+		MaxNgramLength: maxN,
+		MinDF:          v.MinDF,
+		Phonetics:      v.Phonetics,
+		Alphabet:       v.Alphabet,
+		Vocabulary:     v.Vocabulary.Keys,
+		DocFreq:        v.DocFreq,
+		NumDocs:        v.NumDocs,
+		SmoothIDF:      v.SmoothIDF,
+		SublinearTF:    v.SublinearTF,
+		Normalize:      v.Normalize,
+	}
+	return json.NewEncoder(w).Encode(&model)
+}
+
+// Load replaces v with a vectorizer written by Save. It fails with
+// ErrModelVersion for another format version and with ErrModelHash if the
+// content does not match the hash saved with it. NgramFunc is set to the one
+// of the saved analyzer.
+func (v *TfidfVectorizer) Load(r io.Reader) error {
+	var model savedModel
+	if err := json.NewDecoder(r).Decode(&model); err != nil {
+		return err
+	}
+	if model.Version != ModelVersion {
+		return fmt.Errorf("%w: %d", ErrModelVersion, model.Version)
+	}
+	loaded, err := NewTfidfVectorizerRange(model.Analyzer, model.NgramLength, model.MaxNgramLength, model.MinDF)
+	if err != nil {
+		return err
+	}
+	for _, p := range model.Phonetics {
+		if !p.Valid() {
+			return fmt.Errorf("unknown phonetic encoder %s", p)
+		}
+	}
+	loaded.Phonetics = model.Phonetics
+	if model.DocFreq != nil && len(model.DocFreq) != len(model.Vocabulary) {
+		return fmt.Errorf("%d document frequencies for %d terms", len(model.DocFreq), len(model.Vocabulary))
+	}
+	if err := CheckDocFreq(model.DocFreq, model.NumDocs); err != nil {
+		return err
+	}
+	for _, term := range model.Vocabulary {
+		loaded.Vocabulary.Set(term)
+	}
+	if loaded.Vocabulary.Size() != len(model.Vocabulary) {
+		return fmt.Errorf("vocabulary repeats terms")
+	}
+	loaded.Alphabet = model.Alphabet
+	loaded.DocFreq = model.DocFreq
+	loaded.NumDocs = model.NumDocs
+	loaded.SmoothIDF = model.SmoothIDF
+	loaded.SublinearTF = model.SublinearTF
+	loaded.Normalize = model.Normalize
+
+	sum := loaded.Hash()
+	if hex.EncodeToString(sum[:]) != model.Hash {
+		return ErrModelHash
+	}
+	*v = *loaded
+	return nil
+}
@@ -0,0 +1,772 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Phonetic selects a phonetic encoder whose codes a TfidfVectorizer adds as
+// extra features, so that spellings that sound alike, like "mohammed" and
+// "muhammad", share features their n-grams do not.
+type Phonetic int
+
+const (
+	PhoneticSoundex Phonetic = iota + 1
+	PhoneticDoubleMetaphone
+	PhoneticNYSIIS
+)
+
+func (p Phonetic) String() string {
+	switch p {
+	case PhoneticSoundex:
+		return "soundex"
+	case PhoneticDoubleMetaphone:
+		return "double_metaphone"
+	case PhoneticNYSIIS:
+		return "nysiis"
+	}
+	return fmt.Sprintf("Phonetic(%d)", int(p))
+}
+
+// Encode returns the codes of word: one for Soundex and NYSIIS, and the
+// primary and, where it differs, the secondary code for Double Metaphone.
+// A word without Latin letters has no code.
+func (p Phonetic) Encode(word string) []string {
+	var codes []string
+	switch p {
+	case PhoneticSoundex:
+		codes = []string{Soundex(word)}
+	case PhoneticNYSIIS:
+		codes = []string{NYSIIS(word)}
+	case PhoneticDoubleMetaphone:
+		primary, secondary := DoubleMetaphone(word)
+		codes = []string{primary}
+		if secondary != primary {
+			codes = append(codes, secondary)
+		}
+	}
+	result := codes[:0]
+	for _, code := range codes {
+		if code != "" {
+			result = append(result, code)
+		}
+	}
+	return result
+}
+
+// Valid reports whether p is one of the encoders above.
+func (p Phonetic) Valid() bool {
+	return p >= PhoneticSoundex && p <= PhoneticNYSIIS
+}
+
+// asciiLetters returns the letters a to z of word, upper-cased.
+func asciiLetters(word string) []byte {
+	var letters []byte
+	for _, r := range strings.ToUpper(word) {
+		if r >= 'A' && r <= 'Z' {
+			letters = append(letters, byte(r))
+		}
+	}
+	return letters
+}
+
+// soundexCodes holds the Soundex digit of every letter, or 0 for the
+// letters that are not coded.
+var soundexCodes = [26]byte{
+	0, '1', '2', '3', 0, '1', '2', 0, 0, '2', '2', '4', '5',
+	'5', 0, '1', '2', '6', '2', '3', 0, '1', 0, '2', 0, '2',
+}
+
+// Soundex returns the American Soundex code of word, e.g. "R163" for both
+// "Robert" and "Rupert". Letters with the same digit are coded once when
+// they are adjacent or separated only by H or W.
+func Soundex(word string) string {
+	letters := asciiLetters(word)
+	if len(letters) == 0 {
+		return ""
+	}
+	code := []byte{letters[0]}
+	last := soundexCodes[letters[0]-'A']
+	for _, c := range letters[1:] {
+		digit := soundexCodes[c-'A']
+		switch {
+		case c == 'H' || c == 'W':
+			continue
+		case digit == 0:
+			// A vowel separates letters with the same digit.
+			last = 0
+			continue
+		case digit != last:
+			code = append(code, digit)
+		}
+		last = digit
+		if len(code) == 4 {
+			break
+		}
+	}
+	for len(code) < 4 {
+		code = append(code, '0')
+	}
+	return string(code)
+}
+
+func isNYSIISVowel(c byte) bool {
+	return c == 'A' || c == 'E' || c == 'I' || c == 'O' || c == 'U'
+}
+
+// NYSIIS returns the New York State Identification and Intelligence System
+// code of word, truncated to six letters.
+func NYSIIS(word string) string {
+	name := string(asciiLetters(word))
+	if name == "" {
+		return ""
+	}
+	for _, prefix := range [][2]string{{"MAC", "MCC"}, {"KN", "NN"}, {"K", "C"}, {"PH", "FF"}, {"PF", "FF"}, {"SCH", "SSS"}} {
+		if strings.HasPrefix(name, prefix[0]) {
+			name = prefix[1] + name[len(prefix[0]):]
+			break
+		}
+	}
+	for _, suffix := range [][2]string{{"EE", "Y"}, {"IE", "Y"}, {"DT", "D"}, {"RT", "D"}, {"RD", "D"}, {"NT", "D"}, {"ND", "D"}} {
+		if strings.HasSuffix(name, suffix[0]) {
+			name = name[:len(name)-len(suffix[0])] + suffix[1]
+			break
+		}
+	}
+
+	b := []byte(name)
+	at := func(i int) byte {
+		if i < len(b) {
+			return b[i]
+		}
+		return 0
+	}
+	key := []byte{b[0]}
+	for i := 1; i < len(b); i++ {
+		switch c := b[i]; {
+		case c == 'E' && at(i+1) == 'V':
+			b[i], b[i+1] = 'A', 'F'
+		case isNYSIISVowel(c):
+			b[i] = 'A'
+		case c == 'Q':
+			b[i] = 'G'
+		case c == 'Z':
+			b[i] = 'S'
+		case c == 'M':
+			b[i] = 'N'
+		case c == 'K':
+			if at(i+1) == 'N' {
+				b[i] = 'N'
+			} else {
+				b[i] = 'C'
+			}
+		case c == 'S' && at(i+1) == 'C' && at(i+2) == 'H':
+			b[i+1], b[i+2] = 'S', 'S'
+		case c == 'P' && at(i+1) == 'H':
+			b[i], b[i+1] = 'F', 'F'
+		case c == 'H' && (!isNYSIISVowel(b[i-1]) || !isNYSIISVowel(at(i+1))):
+			b[i] = b[i-1]
+		case c == 'W' && isNYSIISVowel(b[i-1]):
+			b[i] = b[i-1]
+		}
+		if b[i] != key[len(key)-1] {
+			key = append(key, b[i])
+		}
+	}
+
+	if len(key) > 1 && key[len(key)-1] == 'S' {
+		key = key[:len(key)-1]
+	}
+	if len(key) > 2 && string(key[len(key)-2:]) == "AY" {
+		key = append(key[:len(key)-2], 'Y')
+	}
+	if len(key) > 1 && key[len(key)-1] == 'A' {
+		key = key[:len(key)-1]
+	}
+	if len(key) > 6 {
+		key = key[:6]
+	}
+	return string(key)
+}
+
+// metaphone holds the state of one DoubleMetaphone run.
+type metaphone struct {
+	word               []rune // upper-cased and padded with spaces
+	length, last       int
+	primary, secondary strings.Builder
+}
+
+func (m *metaphone) at(i int) rune {
+	if i < 0 || i >= len(m.word) {
+		return 0
+	}
+	return m.word[i]
+}
+
+// stringAt reports whether one of options starts at position start.
+func (m *metaphone) stringAt(start int, options ...string) bool {
+	if start < 0 {
+		return false
+	}
+	for _, option := range options {
+		n := len([]rune(option))
+		if start+n <= len(m.word) && string(m.word[start:start+n]) == option {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *metaphone) isVowel(i int) bool {
+	if i < 0 || i >= m.length {
+		return false
+	}
+	switch m.word[i] {
+	case 'A', 'E', 'I', 'O', 'U', 'Y':
+		return true
+	}
+	return false
+}
+
+func (m *metaphone) slavoGermanic() bool {
+	s := string(m.word)
+	return strings.Contains(s, "W") || strings.Contains(s, "K") || strings.Contains(s, "CZ") || strings.Contains(s, "WITZ")
+}
+
+// add appends main to both codes.
+func (m *metaphone) add(main string) {
+	m.primary.WriteString(main)
+	m.secondary.WriteString(main)
+}
+
+// add2 appends main to the primary and alt to the secondary code. A blank
+// alt adds nothing to the secondary code.
+func (m *metaphone) add2(main, alt string) {
+	m.primary.WriteString(main)
+	if alt != " " {
+		m.secondary.WriteString(alt)
+	}
+}
+
+// DoubleMetaphone returns the primary and secondary Double Metaphone codes of
+// word, each at most four characters long, e.g. "SM0" and "XMT" for "Smith".
+// The secondary code is an alternative pronunciation and equals the primary
+// one when there is none.
+func DoubleMetaphone(word string) (string, string) {
+	upper := []rune(strings.ToUpper(strings.TrimSpace(word)))
+	if len(upper) == 0 {
+		return "", ""
+	}
+	m := &metaphone{word: append(upper, []rune("     ")...), length: len(upper), last: len(upper) - 1}
+
+	current := 0
+	// Skip these when at the start of a word.
+	if m.stringAt(0, "GN", "KN", "PN", "WR", "PS") {
+		current++
+	}
+	// An initial X is pronounced Z, as in "Xavier".
+	if m.at(0) == 'X' {
+		m.add("S")
+		current++
+	}
+
+	for m.primary.Len() < 4 || m.secondary.Len() < 4 {
+		if current >= m.length {
+			break
+		}
+		switch m.at(current) {
+		case 'A', 'E', 'I', 'O', 'U', 'Y':
+			// All initial vowels map to A.
+			if current == 0 {
+				m.add("A")
+			}
+			current++
+		case 'B':
+			// "-mb", as in "dumb", is skipped over under M.
+			m.add("P")
+			current += skipDouble(m, current, 'B')
+		case 'Ç':
+			m.add("S")
+			current++
+		case 'C':
+			current = m.handleC(current)
+		case 'D':
+			switch {
+			case m.stringAt(current, "DG") && m.stringAt(current+2, "I", "E", "Y"):
+				// "edge"
+				m.add("J")
+				current += 3
+			case m.stringAt(current, "DG"):
+				// "edgar"
+				m.add("TK")
+				current += 2
+			case m.stringAt(current, "DT", "DD"):
+				m.add("T")
+				current += 2
+			default:
+				m.add("T")
+				current++
+			}
+		case 'F':
+			current += skipDouble(m, current, 'F')
+			m.add("F")
+		case 'G':
+			current = m.handleG(current)
+		case 'H':
+			// Only kept if first and before a vowel, or between two vowels.
+			if (current == 0 || m.isVowel(current-1)) && m.isVowel(current+1) {
+				m.add("H")
+				current += 2
+			} else {
+				current++
+			}
+		case 'J':
+			current = m.handleJ(current)
+		case 'K':
+			current += skipDouble(m, current, 'K')
+			m.add("K")
+		case 'L':
+			if m.at(current+1) == 'L' {
+				// Spanish, as in "cabrillo" and "gallegos".
+				if (current == m.length-3 && m.stringAt(current-1, "ILLO", "ILLA", "ALLE")) ||
+					((m.stringAt(m.last-1, "AS", "OS") || m.stringAt(m.last, "A", "O")) && m.stringAt(current-1, "ALLE")) {
+					m.add2("L", " ")
+					current += 2
+					break
+				}
+				current += 2
+			} else {
+				current++
+			}
+			m.add("L")
+		case 'M':
+			// "dumb", "thumb"
+			if (m.stringAt(current-1, "UMB") && (current+1 == m.last || m.stringAt(current+2, "ER"))) || m.at(current+1) == 'M' {
+				current += 2
+			} else {
+				current++
+			}
+			m.add("M")
+		case 'N':
+			current += skipDouble(m, current, 'N')
+			m.add("N")
+		case 'Ñ':
+			current++
+			m.add("N")
+		case 'P':
+			if m.at(current+1) == 'H' {
+				m.add("F")
+				current += 2
+				break
+			}
+			// Also "campbell", "raspberry".
+			if m.stringAt(current+1, "P", "B") {
+				current += 2
+			} else {
+				current++
+			}
+			m.add("P")
+		case 'Q':
+			current += skipDouble(m, current, 'Q')
+			m.add("K")
+		case 'R':
+			// French, as in "rogier", but not "hochmeier".
+			if current == m.last && !m.slavoGermanic() && m.stringAt(current-2, "IE") && !m.stringAt(current-4, "ME", "MA") {
+				m.add2("", "R")
+			} else {
+				m.add("R")
+			}
+			current += skipDouble(m, current, 'R')
+		case 'S':
+			current = m.handleS(current)
+		case 'T':
+			current = m.handleT(current)
+		case 'V':
+			current += skipDouble(m, current, 'V')
+			m.add("F")
+		case 'W':
+			current = m.handleW(current)
+		case 'X':
+			// French, as in "breaux".
+			if !(current == m.last && (m.stringAt(current-3, "IAU", "EAU") || m.stringAt(current-2, "AU", "OU"))) {
+				m.add("KS")
+			}
+			if m.stringAt(current+1, "C", "X") {
+				current += 2
+			} else {
+				current++
+			}
+		case 'Z':
+			// Chinese pinyin, as in "zhao".
+			if m.at(current+1) == 'H' {
+				m.add("J")
+				current += 2
+				break
+			}
+			if m.stringAt(current+1, "ZO", "ZI", "ZA") || (m.slavoGermanic() && current > 0 && m.at(current-1) != 'T') {
+				m.add2("S", "TS")
+			} else {
+				m.add("S")
+			}
+			current += skipDouble(m, current, 'Z')
+		default:
+			current++
+		}
+	}
+	return truncate(m.primary.String(), 4), truncate(m.secondary.String(), 4)
+}
+
+// skipDouble returns 2 if c is repeated after current and 1 otherwise.
+func skipDouble(m *metaphone, current int, c rune) int {
+	if m.at(current+1) == c {
+		return 2
+	}
+	return 1
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+func (m *metaphone) handleC(current int) int {
+	// Various Germanic.
+	if current > 1 && !m.isVowel(current-2) && m.stringAt(current-1, "ACH") &&
+		m.at(current+2) != 'I' && (m.at(current+2) != 'E' || m.stringAt(current-2, "BACHER", "MACHER")) {
+		m.add("K")
+		return current + 2
+	}
+	// "caesar"
+	if current == 0 && m.stringAt(current, "CAESAR") {
+		m.add("S")
+		return current + 2
+	}
+	// Italian "chianti".
+	if m.stringAt(current, "CHIA") {
+		m.add("K")
+		return current + 2
+	}
+	if m.stringAt(current, "CH") {
+		// "michael"
+		if current > 0 && m.stringAt(current, "CHAE") {
+			m.add2("K", "X")
+			return current + 2
+		}
+		// Greek roots, as in "chemistry" and "chorus".
+		if current == 0 && (m.stringAt(current+1, "HARAC", "HARIS") || m.stringAt(current+1, "HOR", "HYM", "HIA", "HEM")) &&
+			!m.stringAt(0, "CHORE") {
+			m.add("K")
+			return current + 2
+		}
+		// Germanic, Greek or otherwise CH for a KH sound.
+		if m.stringAt(0, "VAN ", "VON ", "SCH") ||
+			// "architect" but not "arch", "orchestra", "orchid"
+			m.stringAt(current-2, "ORCHES", "ARCHIT", "ORCHID") ||
+			m.stringAt(current+2, "T", "S") ||
+			((m.stringAt(current-1, "A", "O", "U", "E") || current == 0) &&
+				// "wachtler", "wechsler", but not "tichner"
+				m.stringAt(current+2, "L", "R", "N", "M", "B", "H", "F", "V", "W", " ")) {
+			m.add("K")
+		} else if current > 0 {
+			if m.stringAt(0, "MC") {
+				// "mchugh"
+				m.add("K")
+			} else {
+				m.add2("X", "K")
+			}
+		} else {
+			m.add("X")
+		}
+		return current + 2
+	}
+	// "czerny"
+	if m.stringAt(current, "CZ") && !m.stringAt(current-2, "WICZ") {
+		m.add2("S", "X")
+		return current + 2
+	}
+	// "focaccia"
+	if m.stringAt(current+1, "CIA") {
+		m.add("X")
+		return current + 3
+	}
+	// Double C, but not as in "mcclellan".
+	if m.stringAt(current, "CC") && !(current == 1 && m.at(0) == 'M') {
+		// "bellocchio" but not "bacchus"
+		if m.stringAt(current+2, "I", "E", "H") && !m.stringAt(current+2, "HU") {
+			if (current == 1 && m.at(current-1) == 'A') || m.stringAt(current-1, "UCCEE", "UCCES") {
+				// "accident", "accede", "succeed"
+				m.add("KS")
+			} else {
+				// "bacci", "bertucci", other Italian
+				m.add("X")
+			}
+			return current + 3
+		}
+		// Pierce's rule
+		m.add("K")
+		return current + 2
+	}
+	if m.stringAt(current, "CK", "CG", "CQ") {
+		m.add("K")
+		return current + 2
+	}
+	if m.stringAt(current, "CI", "CE", "CY") {
+		// Italian vs. English
+		if m.stringAt(current, "CIO", "CIE", "CIA") {
+			m.add2("S", "X")
+		} else {
+			m.add("S")
+		}
+		return current + 2
+	}
+	m.add("K")
+	// "mac caffrey", "mac gregor"
+	if m.stringAt(current+1, " C", " Q", " G") {
+		return current + 3
+	}
+	if m.stringAt(current+1, "C", "K", "Q") && !m.stringAt(current+1, "CE", "CI") {
+		return current + 2
+	}
+	return current + 1
+}
+
+func (m *metaphone) handleG(current int) int {
+	if m.at(current+1) == 'H' {
+		if current > 0 && !m.isVowel(current-1) {
+			m.add("K")
+			return current + 2
+		}
+		// "ghislane", "ghiradelli"
+		if current == 0 {
+			if m.at(current+2) == 'I' {
+				m.add("J")
+			} else {
+				m.add("K")
+			}
+			return current + 2
+		}
+		// Parker's rule, as in "hugh", "bough" and "broughton".
+		if (current > 1 && m.stringAt(current-2, "B", "H", "D")) ||
+			(current > 2 && m.stringAt(current-3, "B", "H", "D")) ||
+			(current > 3 && m.stringAt(current-4, "B", "H")) {
+			return current + 2
+		}
+		// "laugh", "mclaughlin", "cough", "gough", "rough", "tough"
+		if current > 2 && m.at(current-1) == 'U' && m.stringAt(current-3, "C", "G", "L", "R", "T") {
+			m.add("F")
+		} else if current > 0 && m.at(current-1) != 'I' {
+			m.add("K")
+		}
+		return current + 2
+	}
+	if m.at(current+1) == 'N' {
+		if current == 1 && m.isVowel(0) && !m.slavoGermanic() {
+			m.add2("KN", "N")
+		} else if !m.stringAt(current+2, "EY") && m.at(current+1) != 'Y' && !m.slavoGermanic() {
+			// Not as in "cagney".
+			m.add2("N", "KN")
+		} else {
+			m.add("KN")
+		}
+		return current + 2
+	}
+	// "tagliaro"
+	if m.stringAt(current+1, "LI") && !m.slavoGermanic() {
+		m.add2("KL", "L")
+		return current + 2
+	}
+	// -ges-, -gep-, -gel-, -gie- at the beginning
+	if current == 0 && (m.at(current+1) == 'Y' ||
+		m.stringAt(current+1, "ES", "EP", "EB", "EL", "EY", "IB", "IL", "IN", "IE", "EI", "ER")) {
+		m.add2("K", "J")
+		return current + 2
+	}
+	// -ger-, -gy-
+	if (m.stringAt(current+1, "ER") || m.at(current+1) == 'Y') &&
+		!m.stringAt(0, "DANGER", "RANGER", "MANGER") &&
+		!m.stringAt(current-1, "E", "I") && !m.stringAt(current-1, "RGY", "OGY") {
+		m.add2("K", "J")
+		return current + 2
+	}
+	// Italian, as in "biaggi".
+	if m.stringAt(current+1, "E", "I", "Y") || m.stringAt(current-1, "AGGI", "OGGI") {
+		if m.stringAt(0, "VAN ", "VON ", "SCH") || m.stringAt(current+1, "ET") {
+			// Obviously Germanic.
+			m.add("K")
+		} else if m.stringAt(current+1, "IER ") {
+			// Always soft with a French ending.
+			m.add("J")
+		} else {
+			m.add2("J", "K")
+		}
+		return current + 2
+	}
+	m.add("K")
+	return current + skipDouble(m, current, 'G')
+}
+
+func (m *metaphone) handleJ(current int) int {
+	// Obviously Spanish, "jose", "san jacinto".
+	if m.stringAt(current, "JOSE") || m.stringAt(0, "SAN ") {
+		if (current == 0 && m.at(current+4) == ' ') || m.stringAt(0, "SAN ") {
+			m.add("H")
+		} else {
+			m.add2("J", "H")
+		}
+		return current + 1
+	}
+	if current == 0 && !m.stringAt(current, "JOSE") {
+		// "yankelovich", "jankelowicz"
+		m.add2("J", "A")
+	} else if m.isVowel(current-1) && !m.slavoGermanic() && (m.at(current+1) == 'A' || m.at(current+1) == 'O') {
+		// Spanish pronunciation, as in "bajador".
+		m.add2("J", "H")
+	} else if current == m.last {
+		m.add2("J", " ")
+	} else if !m.stringAt(current+1, "L", "T", "K", "S", "N", "M", "B", "Z") && !m.stringAt(current-1, "S", "K", "L") {
+		m.add("J")
+	}
+	return current + skipDouble(m, current, 'J')
+}
+
+func (m *metaphone) handleS(current int) int {
+	// "island", "isle", "carlisle", "carlysle"
+	if m.stringAt(current-1, "ISL", "YSL") {
+		return current + 1
+	}
+	// "sugar-"
+	if current == 0 && m.stringAt(current, "SUGAR") {
+		m.add2("X", "S")
+		return current + 1
+	}
+	if m.stringAt(current, "SH") {
+		if m.stringAt(current+1, "HEIM", "HOEK", "HOLM", "HOLZ") {
+			// Germanic
+			m.add("S")
+		} else {
+			m.add("X")
+		}
+		return current + 2
+	}
+	// Italian and Armenian.
+	if m.stringAt(current, "SIO", "SIA", "SIAN") {
+		if !m.slavoGermanic() {
+			m.add2("S", "X")
+		} else {
+			m.add("S")
+		}
+		return current + 3
+	}
+	// German and anglicisations, "smith" matching "schmidt" and "snider"
+	// matching "schneider"; also -sz- in Slavic languages.
+	if (current == 0 && m.stringAt(current+1, "M", "N", "L", "W")) || m.stringAt(current+1, "Z") {
+		m.add2("S", "X")
+		if m.stringAt(current+1, "Z") {
+			return current + 2
+		}
+		return current + 1
+	}
+	if m.stringAt(current, "SC") {
+		// Schlesinger's rule
+		if m.at(current+2) == 'H' {
+			// Dutch origin, as in "school" and "schooner".
+			if m.stringAt(current+3, "OO", "ER", "EN", "UY", "ED", "EM") {
+				if m.stringAt(current+3, "ER", "EN") {
+					// "schermerhorn", "schenker"
+					m.add2("X", "SK")
+				} else {
+					m.add("SK")
+				}
+				return current + 3
+			}
+			if current == 0 && !m.isVowel(3) && m.at(3) != 'W' {
+				m.add2("X", "S")
+			} else {
+				m.add("X")
+			}
+			return current + 3
+		}
+		if m.stringAt(current+2, "I", "E", "Y") {
+			m.add("S")
+			return current + 3
+		}
+		m.add("SK")
+		return current + 3
+	}
+	// French, as in "resnais" and "artois".
+	if current == m.last && m.stringAt(current-2, "AI", "OI") {
+		m.add2("", "S")
+	} else {
+		m.add("S")
+	}
+	if m.stringAt(current+1, "S", "Z") {
+		return current + 2
+	}
+	return current + 1
+}
+
+func (m *metaphone) handleT(current int) int {
+	if m.stringAt(current, "TION", "TIA", "TCH") {
+		m.add("X")
+		return current + 3
+	}
+	if m.stringAt(current, "TH", "TTH") {
+		// "thomas", "thames" or Germanic
+		if m.stringAt(current+2, "OM", "AM") || m.stringAt(0, "VAN ", "VON ", "SCH") {
+			m.add("T")
+		} else {
+			m.add2("0", "T")
+		}
+		return current + 2
+	}
+	m.add("T")
+	if m.stringAt(current+1, "T", "D") {
+		return current + 2
+	}
+	return current + 1
+}
+
+func (m *metaphone) handleW(current int) int {
+	// Can also be in the middle of a word.
+	if m.stringAt(current, "WR") {
+		m.add("R")
+		return current + 2
+	}
+	if current == 0 && (m.isVowel(current+1) || m.stringAt(current, "WH")) {
+		if m.isVowel(current + 1) {
+			// "wasserman" should match "vasserman"
+			m.add2("A", "F")
+		} else {
+			// "uomo" should match "womo"
+			m.add("A")
+		}
+	}
+	// "arnow" should match "arnoff"
+	if (current == m.last && m.isVowel(current-1)) ||
+		m.stringAt(current-1, "EWSKI", "EWSKY", "OWSKI", "OWSKY") || m.stringAt(0, "SCH") {
+		m.add2("", "F")
+		return current + 1
+	}
+	// Polish, as in "filipowicz".
+	if m.stringAt(current, "WICZ", "WITZ") {
+		m.add2("TS", "FX")
+		return current + 4
+	}
+	return current + 1
+}
+
+// phoneticTokens returns the codes of every word of text under encoders,
+// each tagged with its encoder, e.g. "/soundex/M530".
+func phoneticTokens(text string, encoders []Phonetic) []string {
+	var result []string
+	for _, word := range CalculateWordNGrams(text, 1) {
+		for _, p := range encoders {
+			for _, code := range p.Encode(word) {
+				result = append(result, WordMarker+p.String()+WordMarker+code)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,243 @@
+package data
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Cleaner turns a raw name into the form that is vectorized. Both parties of
+// a match must clean with the same Cleaner, or their vectors won't line up.
+type Cleaner interface {
+	Clean(name string) string
+}
+
+// CleanerFunc adapts a function to a Cleaner.
+type CleanerFunc func(name string) string
+
+func (f CleanerFunc) Clean(name string) string {
+	return f(name)
+}
+
+// Chain is a Cleaner that runs its steps in order and trims the result.
+type Chain []Cleaner
+
+func (c Chain) Clean(name string) string {
+	for _, step := range c {
+		name = step.Clean(name)
+	}
+	return strings.TrimSpace(name)
+}
+
+// PunctuationPolicy decides what happens to the characters a name keeps
+// neither as letters, digits nor spaces.
+type PunctuationPolicy int
+
+const (
+	// PunctuationDelete removes them, so that "Bär-Hönig" cleans to
+	// "barhonig" and "A.B.C." to "abc".
+	PunctuationDelete PunctuationPolicy = iota
+	// PunctuationSpace replaces them with a space, so that "Bär-Hönig" cleans
+	// to "bar honig", but also "B.V." to "b v".
+	PunctuationSpace
+)
+
+func (p PunctuationPolicy) String() string {
+	switch p {
+	case PunctuationDelete:
+		return "delete"
+	case PunctuationSpace:
+		return "space"
+	}
+	return fmt.Sprintf("punctuation(%d)", int(p))
+}
+
+func (p PunctuationPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *PunctuationPolicy) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "delete", "":
+		*p = PunctuationDelete
+	case "space":
+		*p = PunctuationSpace
+	default:
+		return fmt.Errorf("unknown punctuation policy %q", text)
+	}
+	return nil
+}
+
+// apply removes or replaces the punctuation of s and collapses its spaces.
+func (p PunctuationPolicy) apply(s string) string {
+	if p == PunctuationSpace {
+		s = punctuation.ReplaceAllString(s, " ")
+		return whitespace.ReplaceAllString(s, " ")
+	}
+	return removePunctuation(s)
+}
+
+// The steps a Chain can be built from. Normalize removes accents and lowers
+// case, and the others expect names it has normalized, except
+// Transliterator, which must run before it, see Transliterate.
+var (
+	Normalize      Cleaner = CleanerFunc(normalizeString)
+	Transliterator Cleaner = CleanerFunc(Transliterate)
+)
+
+// Punctuation returns the step that applies policy.
+func Punctuation(policy PunctuationPolicy) Cleaner {
+	return CleanerFunc(policy.apply)
+}
+
+// Suffixes returns the step that replaces the legal form suffixes of
+// standards, as NewCompanyNameCleaner does.
+func Suffixes(standards SuffixStandards, priority ...string) Cleaner {
+	return CleanerFunc(NewCompanyNameCleaner(standards, priority...).replaceSuffixes)
+}
+
+// Names of the steps in a PipelineConfig.
+const (
+	StepNormalize     = "normalize"
+	StepTransliterate = "transliterate"
+	StepPunctuation   = "punctuation"
+	StepSuffixes      = "suffixes"
+	StepTokens        = "tokens"
+)
+
+// StepConfig is one step of a PipelineConfig. Step is one of the Step
+// constants; the other fields only apply to the step they name.
+type StepConfig struct {
+	Step string `json:"step" yaml:"step"`
+	// Punctuation is the policy of a punctuation step.
+	Punctuation PunctuationPolicy `json:"punctuation,omitempty" yaml:"punctuation,omitempty"`
+	// Suffixes and Priority configure a suffixes step, see
+	// NewCompanyNameCleaner. Without Suffixes the built-in standards are used.
+	Suffixes SuffixStandards `json:"suffixes,omitempty" yaml:"suffixes,omitempty"`
+	Priority []string        `json:"priority,omitempty" yaml:"priority,omitempty"`
+	// Language and Tokens configure a tokens step: the DefaultTokenRules of
+	// Language, if set, merged with Tokens.
+	Language string     `json:"language,omitempty" yaml:"language,omitempty"`
+	Tokens   TokenRules `json:"tokens,omitempty" yaml:"tokens,omitempty"`
+}
+
+// PipelineConfig defines a cleaning Pipeline, typically loaded with
+// Loader.LoadPipelineConfig.
+type PipelineConfig struct {
+	// Version names the pipeline in logs and protocol messages.
+	Version string       `json:"version" yaml:"version"`
+	Steps   []StepConfig `json:"steps" yaml:"steps"`
+}
+
+// DefaultPipelineConfig returns the steps of CleanCompanyName: normalize,
+// delete punctuation and replace the built-in suffixes.
+func DefaultPipelineConfig() PipelineConfig {
+	return PipelineConfig{
+		Version: "default",
+		Steps: []StepConfig{
+			{Step: StepNormalize},
+			{Step: StepPunctuation, Punctuation: PunctuationDelete},
+			{Step: StepSuffixes},
+		},
+	}
+}
+
+// Pipeline is a Cleaner built from a PipelineConfig. Besides its Version it
+// has a Hash of the resolved configuration, so that two parties can check
+// they clean identically even if both call their pipeline "v1".
+type Pipeline struct {
+	version string
+	hash    [sha256.Size]byte
+	steps   Chain
+}
+
+// NewPipeline builds the steps of config. It resolves the defaults each step
+// relies on before hashing, so that a pipeline using the built-in suffixes
+// changes hash when they change.
+func NewPipeline(config PipelineConfig) (*Pipeline, error) {
+	resolved := PipelineConfig{Version: config.Version, Steps: make([]StepConfig, len(config.Steps))}
+	p := &Pipeline{version: config.Version}
+	normalized := false
+	for i, step := range config.Steps {
+		var cleaner Cleaner
+		switch step.Step {
+		case StepNormalize:
+			cleaner = Normalize
+			normalized = true
+		case StepTransliterate:
+			if normalized {
+				return nil, fmt.Errorf("step %d: %s must come before %s", i, StepTransliterate, StepNormalize)
+			}
+			cleaner = Transliterator
+		case StepPunctuation:
+			if step.Punctuation != PunctuationDelete && step.Punctuation != PunctuationSpace {
+				return nil, fmt.Errorf("step %d: unknown punctuation policy %s", i, step.Punctuation)
+			}
+			cleaner = Punctuation(step.Punctuation)
+		case StepSuffixes:
+			if step.Suffixes == nil {
+				step.Suffixes = DefaultSuffixStandards()
+			}
+			if err := step.Suffixes.Validate(); err != nil {
+				return nil, fmt.Errorf("step %d: %w", i, err)
+			}
+			cleaner = Suffixes(step.Suffixes, step.Priority...)
+		case StepTokens:
+			if step.Language != "" {
+				rules, err := DefaultTokenRules(step.Language)
+				if err != nil {
+					return nil, fmt.Errorf("step %d: %w", i, err)
+				}
+				step.Tokens = rules.Merge(step.Tokens)
+				step.Language = ""
+			}
+			cleaner = NewTokenPipeline(step.Tokens)
+		default:
+			return nil, fmt.Errorf("step %d: unknown cleaning step %q", i, step.Step)
+		}
+		resolved.Steps[i] = step
+		p.steps = append(p.steps, cleaner)
+	}
+	// encoding/json sorts map keys, so equal configurations encode equally.
+	encoded, err := json.Marshal(&resolved)
+	if err != nil {
+		return nil, err
+	}
+	p.hash = sha256.Sum256(encoded)
+	return p, nil
+}
+
+// defaultPipeline is shared, since a Pipeline never changes once built.
+var defaultPipeline = func() *Pipeline {
+	p, err := NewPipeline(DefaultPipelineConfig())
+	if err != nil {
+		panic(err)
+	}
+	return p
+}()
+
+// DefaultPipeline returns the pipeline of DefaultPipelineConfig, which cleans
+// like CleanCompanyName.
+func DefaultPipeline() *Pipeline {
+	return defaultPipeline
+}
+
+func (p *Pipeline) Clean(name string) string {
+	return p.steps.Clean(name)
+}
+
+// Version returns the version of the configuration p was built from.
+func (p *Pipeline) Version() string {
+	return p.version
+}
+
+// Hash returns the SHA-256 of the resolved configuration of p.
+func (p *Pipeline) Hash() [sha256.Size]byte {
+	return p.hash
+}
+
+// ID identifies p in logs as its version and the start of its hash.
+func (p *Pipeline) ID() string {
+	return fmt.Sprintf("%s@%x", p.version, p.hash[:8])
+}
@@ -1,7 +1,7 @@
 // Initialize company suffix standards map
 package data
 
-var suffixStandards = map[string][]string{
+var suffixStandards = SuffixStandards{
     "co": {
         "company",
         "incorporated",
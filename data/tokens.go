@@ -0,0 +1,136 @@
+package data
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// TokenRules configures a TokenPipeline. Loader reads them from JSON or YAML,
+// and DefaultTokenRules ships lists per language.
+type TokenRules struct {
+	// Abbreviations maps an abbreviated word to its expansion, e.g. "gebr"
+	// to "gebroeders", so that both spellings give the same features.
+	Abbreviations map[string]string `json:"abbreviations" yaml:"abbreviations"`
+	// Stopwords are dropped, e.g. "stichting" or "holding", which appear in so
+	// many names that they make unrelated entities look alike.
+	Stopwords []string `json:"stopwords" yaml:"stopwords"`
+	// Sort orders the remaining words, so that "bosch van den" and "van den
+	// bosch" give the same name.
+	Sort bool `json:"sort" yaml:"sort"`
+}
+
+// Merge returns the rules of r extended with those of other, whose
+// abbreviations win where both expand the same word.
+func (r TokenRules) Merge(other TokenRules) TokenRules {
+	merged := TokenRules{
+		Abbreviations: make(map[string]string, len(r.Abbreviations)+len(other.Abbreviations)),
+		Stopwords:     append(append([]string(nil), r.Stopwords...), other.Stopwords...),
+		Sort:          r.Sort || other.Sort,
+	}
+	for _, abbreviations := range []map[string]string{r.Abbreviations, other.Abbreviations} {
+		for word, expansion := range abbreviations {
+			merged.Abbreviations[word] = expansion
+		}
+	}
+	return merged
+}
+
+// TokenPipeline rewrites the words of a cleaned name: it expands
+// abbreviations, then drops stopwords, then sorts the words.
+type TokenPipeline struct {
+	abbreviations map[string][]string
+	stopwords     map[string]bool
+	sort          bool
+}
+
+// NewTokenPipeline compiles rules. Words are matched in lower case, as
+// CompanyNameCleaner leaves them.
+func NewTokenPipeline(rules TokenRules) *TokenPipeline {
+	p := &TokenPipeline{
+		abbreviations: make(map[string][]string, len(rules.Abbreviations)),
+		stopwords:     make(map[string]bool, len(rules.Stopwords)),
+		sort:          rules.Sort,
+	}
+	for word, expansion := range rules.Abbreviations {
+		p.abbreviations[strings.ToLower(word)] = strings.Fields(strings.ToLower(expansion))
+	}
+	for _, word := range rules.Stopwords {
+		p.stopwords[strings.ToLower(word)] = true
+	}
+	return p
+}
+
+// Apply rewrites the words of name. A name made only of stopwords, like
+// "holding bv", keeps its words, since dropping them would leave nothing to
+// match on.
+func (p *TokenPipeline) Apply(name string) string {
+	var words []string
+	for _, word := range strings.Fields(name) {
+		if expansion, ok := p.abbreviations[word]; ok {
+			words = append(words, expansion...)
+		} else {
+			words = append(words, word)
+		}
+	}
+	kept := make([]string, 0, len(words))
+	for _, word := range words {
+		if !p.stopwords[word] {
+			kept = append(kept, word)
+		}
+	}
+	if len(kept) > 0 {
+		words = kept
+	}
+	if p.sort {
+		slices.Sort(words)
+	}
+	return strings.Join(words, " ")
+}
+
+// Clean is Apply, so that a TokenPipeline can be a step of a Chain.
+func (p *TokenPipeline) Clean(name string) string {
+	return p.Apply(name)
+}
+
+// defaultTokenRules holds the rules DefaultTokenRules ships, in the form
+// CompanyNameCleaner leaves words: lower case, without accents, and not a
+// suffix variant it replaces, such as "nv".
+var defaultTokenRules = map[string]TokenRules{
+	"en": {
+		Abbreviations: map[string]string{
+			"intl": "international", "natl": "national", "mfg": "manufacturing", "mgmt": "management",
+			"svc": "services", "svcs": "services", "assoc": "association", "bros": "brothers",
+			"grp": "group", "hldg": "holding", "hldgs": "holdings", "dept": "department",
+		},
+		Stopwords: []string{"the", "and", "of", "for", "holding", "holdings", "group"},
+	},
+	"nl": {
+		Abbreviations: map[string]string{
+			"gebr": "gebroeders", "mij": "maatschappij", "mty": "maatschappij", "stg": "stichting",
+			"intl": "internationaal", "ver": "vereniging", "vd": "van de", "vdr": "van der",
+		},
+		Stopwords: []string{
+			"stichting", "maatschappij", "maatschap", "beheer", "holding", "bv", "vof", "cv",
+			"en", "de", "het", "van", "der", "den", "te", "voor",
+		},
+	},
+	"de": {
+		Abbreviations: map[string]string{
+			"gebr": "gebruder", "intl": "international", "verw": "verwaltung", "ges": "gesellschaft",
+		},
+		Stopwords: []string{
+			"und", "der", "die", "das", "fur", "von", "holding", "gruppe", "verwaltung", "gesellschaft", "kg",
+		},
+	},
+}
+
+// DefaultTokenRules returns the shipped rules of a language: "en", "nl" or
+// "de". They expand abbreviations and drop stopwords but do not sort.
+func DefaultTokenRules(language string) (TokenRules, error) {
+	rules, ok := defaultTokenRules[language]
+	if !ok {
+		return TokenRules{}, fmt.Errorf("no default token rules for language %q", language)
+	}
+	return rules.Merge(TokenRules{}), nil
+}
@@ -0,0 +1,70 @@
+package data
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// transliterations maps lower-case Cyrillic, Greek and Arabic letters to
+// Latin. Arabic short vowels are marks, which CompanyNameCleaner removes along
+// with accents, so they are not listed.
+var transliterations = map[rune]string{
+	// Russian, Ukrainian, Belarusian, Serbian and Macedonian Cyrillic.
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e", 'ж': "zh",
+	'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+	'я': "ya", 'є': "ye", 'і': "i", 'ї': "yi", 'ґ': "g", 'ў': "u", 'ђ': "dj", 'ј': "j",
+	'љ': "lj", 'њ': "nj", 'ћ': "c", 'џ': "dz", 'ѓ': "gj", 'ќ': "kj", 'ѕ': "dz",
+
+	// Greek.
+	'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i", 'θ': "th",
+	'ι': "i", 'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p",
+	'ρ': "r", 'σ': "s", 'ς': "s", 'τ': "t", 'υ': "y", 'φ': "f", 'χ': "ch", 'ψ': "ps",
+	'ω': "o",
+
+	// Arabic, with the Persian and Urdu additions.
+	'ا': "a", 'ب': "b", 'ت': "t", 'ث': "th", 'ج': "j", 'ح': "h", 'خ': "kh", 'د': "d",
+	'ذ': "dh", 'ر': "r", 'ز': "z", 'س': "s", 'ش': "sh", 'ص': "s", 'ض': "d", 'ط': "t",
+	'ظ': "z", 'ع': "", 'غ': "gh", 'ف': "f", 'ق': "q", 'ك': "k", 'ل': "l", 'م': "m",
+	'ن': "n", 'ه': "h", 'و': "w", 'ي': "y", 'ى': "a", 'ة': "a", 'ء': "", 'پ': "p",
+	'چ': "ch", 'ژ': "zh", 'گ': "g", 'ک': "k", 'ی': "y",
+}
+
+// greekDigraphs are read as one sound rather than letter by letter.
+var greekDigraphs = strings.NewReplacer("ου", "ou", "αυ", "av", "ευ", "ev")
+
+// Transliterate writes the Cyrillic, Greek and Arabic letters of s in Latin,
+// so that "Газпром" and "Gazprom" clean to the same name. Other characters
+// are left as they are, and upper-case letters are lowered. It must run
+// before accents are removed, which would turn "й" into "и". Greek accents
+// are removed here, so that "ού" reads as the digraph "ου".
+func Transliterate(s string) string {
+	s = greekDigraphs.Replace(stripGreekAccents(strings.ToLower(norm.NFC.String(s))))
+	var b strings.Builder
+	for _, r := range s {
+		if latin, ok := transliterations[r]; ok {
+			b.WriteString(latin)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// stripGreekAccents replaces every accented Greek letter of s with its base
+// letter.
+func stripGreekAccents(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.Is(unicode.Greek, r) {
+			base, _ := utf8.DecodeRuneInString(norm.NFD.String(string(r)))
+			r = base
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
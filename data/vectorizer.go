@@ -1,8 +1,13 @@
 package data
 
 import (
+	"fmt"
 	"math"
 	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/utils"
 )
 
 // OrderedMap maintains both a map for fast lookups and a slice for order preservation
@@ -70,47 +75,262 @@ func (om *OrderedMap) Size() int {
 	return om.Count
 }
 
+// Analyzer selects the tokens a TfidfVectorizer extracts from a name.
+type Analyzer int
+
+const (
+	// AnalyzerChar cuts character n-grams across the whole name.
+	AnalyzerChar Analyzer = iota
+	// AnalyzerCharWB cuts character n-grams within padded words, see
+	// CalculatePaddedNGrams.
+	AnalyzerCharWB
+	// AnalyzerWord takes word n-grams, see CalculateWordNGrams.
+	AnalyzerWord
+	// AnalyzerCombined takes the AnalyzerCharWB n-grams plus every whole word.
+	AnalyzerCombined
+)
+
+// WordMarker prefixes word tokens in the vocabulary. CalculateNGrams strips
+// it from names, so a word never shares a feature with a character n-gram.
+const WordMarker = "/"
+
+func (a Analyzer) String() string {
+	switch a {
+	case AnalyzerChar:
+		return "char"
+	case AnalyzerCharWB:
+		return "char_wb"
+	case AnalyzerWord:
+		return "word"
+	case AnalyzerCombined:
+		return "combined"
+	}
+	return fmt.Sprintf("Analyzer(%d)", int(a))
+}
+
 // TfidfVectorizer implements TF-IDF feature extraction
 type TfidfVectorizer struct {
-	Vocabulary  *OrderedMap
-	NgramFunc   func(string, int) []string
-	NgramLength int
-	MinDF       int
+	Vocabulary *OrderedMap
+	// NgramFunc cuts the character n-grams of the char, char_wb and combined
+	// analyzers.
+	NgramFunc func(string, int) []string
+	// NgramLength is the shortest n-gram and MaxNgramLength the longest; a
+	// MaxNgramLength below NgramLength means NgramLength alone.
+	NgramLength    int
+	MaxNgramLength int
+	Analyzer       Analyzer
+	MinDF          int
+	// Phonetics adds the codes of every word under each encoder as features,
+	// see Phonetic. They need a fitted vocabulary, not an alphabet one.
+	Phonetics []Phonetic
+	// Alphabet is set by FitAlphabet; the vocabulary is then every n-gram
+	// over it rather than the n-grams of a training corpus.
+	Alphabet string
+
+	// DocFreq[i] is the number of training documents containing the n-gram
+	// Vocabulary.Keys[i], out of NumDocs. Both are set by Fit; without them
+	// every n-gram gets the same IDF of 1.
+	DocFreq []int
+	NumDocs int
+
+	// SmoothIDF adds one to every document frequency and to NumDocs, as if
+	// one extra document contained every n-gram once, which avoids zero
+	// divisions: idf = ln((1+n)/(1+df)) + 1, or ln(n/df) + 1 without it.
+	SmoothIDF bool
+	// SublinearTF replaces the term frequency with 1 + ln(count).
+	SublinearTF bool
+	// Normalize scales every vector Transform returns to unit L2 norm.
+	Normalize bool
 }
 
-// NewTfidfVectorizer creates a new TF-IDF vectorizer
+// NewTfidfVectorizer creates a new TF-IDF vectorizer with smooth IDF, plain
+// term frequencies and no normalization.
 func NewTfidfVectorizer(ngramLength, minDF int) *TfidfVectorizer {
 	return &TfidfVectorizer{
 		Vocabulary:  NewOrderedMap(),
 		NgramFunc:   CalculateNGrams,
 		NgramLength: ngramLength,
 		MinDF:       minDF,
+		SmoothIDF:   true,
 	}
 }
 
-// Fit builds the vocabulary from training data
+// NewTfidfVectorizerRange creates a vectorizer over every n-gram length from
+// minN to maxN, e.g. character 2 to 4-grams, with the tokens of analyzer.
+func NewTfidfVectorizerRange(analyzer Analyzer, minN, maxN, minDF int) (*TfidfVectorizer, error) {
+	if minN < 1 || maxN < minN {
+		return nil, fmt.Errorf("invalid n-gram range (%d, %d)", minN, maxN)
+	}
+	v := NewTfidfVectorizer(minN, minDF)
+	v.MaxNgramLength = maxN
+	switch analyzer {
+	case AnalyzerChar, AnalyzerWord:
+	case AnalyzerCharWB, AnalyzerCombined:
+		v.NgramFunc = CalculatePaddedNGrams
+	default:
+		return nil, fmt.Errorf("unknown analyzer %s", analyzer)
+	}
+	v.Analyzer = analyzer
+	return v, nil
+}
+
+// NgramRange returns the shortest and longest n-gram length.
+func (v *TfidfVectorizer) NgramRange() (int, int) {
+	return v.NgramLength, max(v.NgramLength, v.MaxNgramLength)
+}
+
+// tokens returns the tokens of text in a fixed order: by n-gram length, then
+// by position, with the whole words of AnalyzerCombined and the phonetic
+// codes last. Fit relies on it for a deterministic vocabulary.
+func (v *TfidfVectorizer) tokens(text string) []string {
+	minN, maxN := v.NgramRange()
+	var result []string
+	for n := minN; n <= maxN; n++ {
+		if v.Analyzer == AnalyzerWord {
+			for _, words := range CalculateWordNGrams(text, n) {
+				result = append(result, WordMarker+words)
+			}
+		} else {
+			result = append(result, v.NgramFunc(text, n)...)
+		}
+	}
+	if v.Analyzer == AnalyzerCombined {
+		for _, word := range CalculateWordNGrams(text, 1) {
+			result = append(result, WordMarker+word)
+		}
+	}
+	if len(v.Phonetics) > 0 {
+		result = append(result, phoneticTokens(text, v.Phonetics)...)
+	}
+	return result
+}
+
+// Fit builds the vocabulary from training data, in order of first
+// occurrence, and records the document frequency of every n-gram kept. The
+// same training data in the same order always gives the same feature indexes.
 func (v *TfidfVectorizer) Fit(data []string) {
-	// Build vocabulary
-	documentFreq := make(map[string]int)
+	seen := NewOrderedMap()
+	var documentFreq []int
 	for _, text := range data {
-		uniqueNgrams := make(map[string]bool)
-		for _, ngram := range v.NgramFunc(text, v.NgramLength) {
-			uniqueNgrams[ngram] = true
+		inDoc := make(map[string]bool)
+		for _, ngram := range v.tokens(text) {
+			if inDoc[ngram] {
+				continue
+			}
+			inDoc[ngram] = true
+			idx := seen.Set(ngram)
+			if idx == len(documentFreq) {
+				documentFreq = append(documentFreq, 0)
+			}
+			documentFreq[idx]++
 		}
-		for ngram := range uniqueNgrams {
+	}
+
+	// Filter terms based on min_df and rebuild vocabulary
+	v.Vocabulary = NewOrderedMap()
+	v.DocFreq = nil
+	for i, ngram := range seen.Keys {
+		if documentFreq[i] >= v.MinDF {
 			v.Vocabulary.Set(ngram)
-			documentFreq[ngram]++
+			v.DocFreq = append(v.DocFreq, documentFreq[i])
 		}
 	}
+	v.NumDocs = len(data)
+	v.Alphabet = ""
+}
 
-	// Filter terms based on min_df and rebuild vocabulary
-	tempVocab := NewOrderedMap()
-	for _, ngram := range v.Vocabulary.Keys {
-		if documentFreq[ngram] >= v.MinDF {
-			tempVocab.Set(ngram)
+// IDF returns the inverse document frequency of the n-gram at index idx.
+func (v *TfidfVectorizer) IDF(idx int) float64 {
+	if v.DocFreq == nil {
+		return 1
+	}
+	n, df := float64(v.NumDocs), float64(v.DocFreq[idx])
+	if v.SmoothIDF {
+		n, df = n+1, df+1
+	}
+	return math.Log(n/df) + 1
+}
+
+// CheckDocFreq checks that every document frequency is within [1, numDocs],
+// as Fit leaves them. Outside that range IDF is infinite or NaN unless
+// SmoothIDF is set, so frequencies read from elsewhere should be checked.
+func CheckDocFreq(docFreq []int, numDocs int) error {
+	for i, df := range docFreq {
+		if df < 1 || df > numDocs {
+			return fmt.Errorf("document frequency %d of term %d out of range [1, %d]", df, i, numDocs)
+		}
+	}
+	return nil
+}
+
+// DefaultAlphabet holds every character CleanCompanyName leaves in a name.
+const DefaultAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789 "
+
+// MaxAlphabetFeatures caps the vocabulary FitAlphabet builds, so that it still
+// fits the slots of the largest HE ring.
+const MaxAlphabetFeatures = 1 << 16
+
+// FitAlphabet sets the vocabulary to every n-gram over alphabet, shortest
+// first, then ordered by the position of their characters in alphabet. It
+// needs no training data: two parties that agree on the alphabet and n-gram
+// range get identical feature indexes without either revealing a name.
+// N-grams with characters outside the alphabet are ignored by Transform.
+func (v *TfidfVectorizer) FitAlphabet(alphabet string) error {
+	chars := []rune(alphabet)
+	seen := make(map[rune]bool)
+	for _, c := range chars {
+		if seen[c] {
+			return fmt.Errorf("alphabet repeats %q", c)
+		}
+		seen[c] = true
+	}
+	if len(chars) == 0 || v.NgramLength < 1 {
+		return fmt.Errorf("need a non-empty alphabet and a positive n-gram length")
+	}
+	if v.Analyzer == AnalyzerWord || v.Analyzer == AnalyzerCombined {
+		return fmt.Errorf("the %s analyzer has no alphabet vocabulary", v.Analyzer)
+	}
+	if len(v.Phonetics) > 0 {
+		return fmt.Errorf("phonetic features have no alphabet vocabulary")
+	}
+	minN, maxN := v.NgramRange()
+	total := 0
+	for n := minN; n <= maxN; n++ {
+		size := 1
+		for i := 0; i < n; i++ {
+			size *= len(chars)
+			if total+size > MaxAlphabetFeatures {
+				return fmt.Errorf("%d to %d-grams over %d characters exceed %d features", minN, maxN, len(chars), MaxAlphabetFeatures)
+			}
 		}
+		total += size
 	}
-	v.Vocabulary = tempVocab
+
+	vocab := NewOrderedMap()
+	for n := minN; n <= maxN; n++ {
+		size := 1
+		for i := 0; i < n; i++ {
+			size *= len(chars)
+		}
+		ngram := make([]rune, n)
+		for i := 0; i < size; i++ {
+			// Spell i in base len(chars), most significant digit first.
+			for k, rest := n-1, i; k >= 0; k-- {
+				ngram[k] = chars[rest%len(chars)]
+				rest /= len(chars)
+			}
+			vocab.Set(string(ngram))
+		}
+	}
+	v.Vocabulary = vocab
+	v.Alphabet = alphabet
+	v.DocFreq, v.NumDocs = nil, 0
+	return nil
+}
+
+// Size returns the vector length, the size of the vocabulary.
+func (v *TfidfVectorizer) Size() int {
+	return v.Vocabulary.Size()
 }
 
 // BatchTransform converts a batch of text into TF-IDF vectors
@@ -124,42 +344,101 @@ func (v *TfidfVectorizer) BatchTransform(data []string) [][]float64 {
 	return tfidfMatrix
 }
 
-// Transform converts a single text into a TF-IDF vector
+// Transform converts a single text into a dense TF-IDF vector, see
+// TransformSparse.
 func (v *TfidfVectorizer) Transform(text string) []float64 {
-	ngrams := v.NgramFunc(text, v.NgramLength)
-	tfidfVector := make([]float64, v.Vocabulary.Size())
+	return v.TransformSparse(text).Dense(v.Vocabulary.Size())
+}
+
+// BatchTransformSparse converts a batch of text into sparse TF-IDF vectors.
+func (v *TfidfVectorizer) BatchTransformSparse(data []string) []utils.SparseVector {
+	vectors := make([]utils.SparseVector, len(data))
+	for i, text := range data {
+		vectors[i] = v.TransformSparse(text)
+	}
+	return vectors
+}
 
-	// Calculate term frequency (TF)
-	wordFreq := make(map[string]int)
+// TransformSparse converts a single text into a TF-IDF vector holding only
+// the n-grams of text. The term frequency of an n-gram is its count divided
+// by the number of n-grams in text, or 1 + ln(count) with SublinearTF.
+func (v *TfidfVectorizer) TransformSparse(text string) utils.SparseVector {
+	ngrams := v.tokens(text)
+
+	// Count the n-grams of the vocabulary.
+	counts := make(map[int]int)
 	for _, ngram := range ngrams {
-		if _, ok := v.Vocabulary.Get(ngram); ok {
-			wordFreq[ngram]++
+		if idx, ok := v.Vocabulary.Get(ngram); ok {
+			counts[idx]++
 		}
 	}
+	var vector utils.SparseVector
+	for idx := range counts {
+		vector.Indices = append(vector.Indices, idx)
+	}
+	sort.Ints(vector.Indices)
 
 	// Calculate TF-IDF
-	for ngram, freq := range wordFreq {
-		if idx, ok := v.Vocabulary.Get(ngram); ok {
-			tf := float64(freq) / float64(len(ngram))
-			idf := math.Log(float64(v.Vocabulary.Size()) / float64(v.MinDF))
-			tfidfVector[idx] = tf * idf
+	vector.Values = make([]float64, len(vector.Indices))
+	for k, idx := range vector.Indices {
+		tf := float64(counts[idx]) / float64(len(ngrams))
+		if v.SublinearTF {
+			tf = 1 + math.Log(float64(counts[idx]))
 		}
+		vector.Values[k] = tf * v.IDF(idx)
 	}
 
-	return tfidfVector
+	if v.Normalize {
+		utils.NormalizeSparse(vector)
+	}
+	return vector
 }
 
-// CalculateNGrams generates n-grams from a string
+// ngramPunctuation is what CalculateNGrams strips before cutting n-grams.
+var ngramPunctuation = regexp.MustCompile(`[,-./]|\sBD`)
+
+// CalculateNGrams generates the character n-grams of a string. It counts in
+// runes, so n-grams of non-Latin names never cut through a UTF-8 sequence.
 func CalculateNGrams(str string, n int) []string {
 	// Remove punctuation from the string
-	reg, _ := regexp.Compile(`[,-./]|\sBD`)
-	str = reg.ReplaceAllString(str, "")
+	runes := []rune(ngramPunctuation.ReplaceAllString(str, ""))
 
 	// Generate n-grams of length n
 	var result []string
-	for i := 0; i < len(str)-n+1; i++ {
-		result = append(result, str[i:i+n])
+	for i := 0; i < len(runes)-n+1; i++ {
+		result = append(result, string(runes[i:i+n]))
+	}
+
+	return result
+}
+
+// CalculatePaddedNGrams generates character n-grams within word boundaries:
+// every word is padded with a space on both sides, so "ab cd" yields " a",
+// "ab", "b ", " c", "cd" and "d " for n = 2. The padding marks where words
+// start and end, and no n-gram spans two words. A padded word shorter than n
+// is kept whole.
+func CalculatePaddedNGrams(str string, n int) []string {
+	var result []string
+	for _, word := range strings.Fields(ngramPunctuation.ReplaceAllString(str, "")) {
+		padded := []rune(" " + word + " ")
+		if len(padded) < n {
+			result = append(result, string(padded))
+			continue
+		}
+		for i := 0; i < len(padded)-n+1; i++ {
+			result = append(result, string(padded[i:i+n]))
+		}
 	}
+	return result
+}
 
+// CalculateWordNGrams generates the n-grams of words of a string, joined by a
+// single space.
+func CalculateWordNGrams(str string, n int) []string {
+	words := strings.Fields(ngramPunctuation.ReplaceAllString(str, ""))
+	var result []string
+	for i := 0; i < len(words)-n+1; i++ {
+		result = append(result, strings.Join(words[i:i+n], " "))
+	}
 	return result
 }
@@ -1 +1,79 @@
+// Package fpsi runs fuzzy private entity set intersection between two
+// parties. The Receiver holds query names and the HE secret key; the Sender
+// holds a store of names. At the end the Receiver learns how similar each of
+// its queries is to each store entry, and the Sender learns nothing.
+//
+// The protocol runs in explicit rounds, each producing one message:
+//
+//  1. Receiver.Setup        -> SetupMessage   parameters and vocabulary
+//  2. Receiver.Keys         -> KeysMessage    evaluation keys
+//  3. Receiver.Query        -> QueryMessage   encrypted query vectors
+//  4. Sender.HandleQuery    -> ScoresMessage  encrypted similarity scores
+//  5. Receiver.Scores          decrypts the scores
+//
+// The Sender consumes the first two messages with HandleSetup and HandleKeys.
+// Every message implements encoding.BinaryMarshaler and BinaryUnmarshaler, so
+// the rounds can run over any transport.
 package fpsi
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/data"
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/utils"
+)
+
+// Round identifies a protocol round and tags its message on the wire.
+type Round uint8
+
+const (
+	RoundSetup Round = iota + 1
+	RoundKeys
+	RoundQuery
+	RoundScores
+)
+
+func (r Round) String() string {
+	switch r {
+	case RoundSetup:
+		return "setup"
+	case RoundKeys:
+		return "keys"
+	case RoundQuery:
+		return "query"
+	case RoundScores:
+		return "scores"
+	}
+	return fmt.Sprintf("round(%d)", uint8(r))
+}
+
+// ErrOutOfOrder is returned when a party is asked to run a round before the
+// rounds it depends on.
+var ErrOutOfOrder = errors.New("fpsi: round out of order")
+
+// ErrModelMismatch is returned when the Receiver's vectorizer is not the
+// model the Sender expects.
+var ErrModelMismatch = errors.New("fpsi: vectorizer model mismatch")
+
+// ErrPipelineMismatch is returned when the Receiver cleans names with another
+// pipeline than the Sender.
+var ErrPipelineMismatch = errors.New("fpsi: cleaning pipeline mismatch")
+
+func outOfOrder(got, want Round) error {
+	return fmt.Errorf("%w: got %s, expected %s", ErrOutOfOrder, got, want)
+}
+
+// vectorize cleans names with pipeline and turns them into unit-length TF-IDF vectors, the
+// same way on both sides. Names without a known n-gram stay all zero. The
+// vectors are built sparse and only expanded to the vocabulary size here,
+// right before encoding.
+func vectorize(vectorizer *data.TfidfVectorizer, pipeline *data.Pipeline, names []string) [][]float64 {
+	vectors := make([][]float64, len(names))
+	for i, name := range names {
+		sparse := vectorizer.TransformSparse(pipeline.Clean(name))
+		utils.NormalizeSparse(sparse)
+		vectors[i] = sparse.Dense(vectorizer.Size())
+	}
+	return vectors
+}
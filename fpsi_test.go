@@ -0,0 +1,305 @@
+package fpsi
+
+import (
+	"context"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/data"
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/hem"
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/serialization"
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+)
+
+var corpus = []string{
+	"acme widgets", "globex", "initech", "umbrella", "wayne enterprises",
+	"stark industries", "wonka chocolate", "cyberdyne systems", "tyrell", "soylent",
+}
+
+// transfer sends a message through its binary encoding, as a real transport would.
+func transfer(t *testing.T, msg encoding.BinaryMarshaler, into encoding.BinaryUnmarshaler) {
+	wire, err := msg.MarshalBinary()
+	assert.NoError(t, err)
+	assert.NoError(t, into.UnmarshalBinary(wire))
+}
+
+func TestProtocolInMemory(t *testing.T) {
+	ctx := context.Background()
+	vectorizer := data.NewTfidfVectorizer(2, 1)
+	vectorizer.Fit(corpus)
+
+	receiver := NewReceiver(hem.InsecureProfile(8, 1), vectorizer)
+	store := []string{"Initech", "Stark Industries Inc", "Globex Corporation", "Bluth Company"}
+	sender := NewSender(store, hem.SecurityNone)
+
+	setup, err := receiver.Setup()
+	assert.NoError(t, err)
+	var gotSetup SetupMessage
+	transfer(t, setup, &gotSetup)
+	assert.Equal(t, setup.Vocabulary, gotSetup.Vocabulary)
+	assert.NoError(t, sender.HandleSetup(&gotSetup))
+
+	keys, err := receiver.Keys()
+	assert.NoError(t, err)
+	var gotKeys KeysMessage
+	transfer(t, keys, &gotKeys)
+	assert.NoError(t, sender.HandleKeys(&gotKeys))
+
+	queries := []string{"stark industries", "initech llc"}
+	query, err := receiver.Query(ctx, queries)
+	assert.NoError(t, err)
+	var gotQuery QueryMessage
+	transfer(t, query, &gotQuery)
+
+	answer, err := sender.HandleQuery(ctx, &gotQuery)
+	assert.NoError(t, err)
+	var gotAnswer ScoresMessage
+	transfer(t, answer, &gotAnswer)
+
+	scores, err := receiver.Scores(ctx, &gotAnswer)
+	assert.NoError(t, err)
+
+	// The encrypted scores match the plaintext pipeline.
+	queryVectors := vectorize(vectorizer, data.DefaultPipeline(), queries)
+	storeVectors := vectorize(vectorizer, data.DefaultPipeline(), store)
+	for i := range queries {
+		assert.Equal(t, len(store), len(scores[i]))
+		for j := range store {
+			want := utils.DotProduct(queryVectors[i], storeVectors[j])
+			assert.InDelta(t, want, scores[i][j], 1e-4, "Score mismatch at (%d,%d)", i, j)
+		}
+	}
+	assert.Greater(t, scores[0][1], 0.9, "stark industries should match Stark Industries Inc")
+	assert.Greater(t, scores[1][0], 0.9, "initech llc should match Initech")
+
+	// The receiver can send another batch with the same keys.
+	_, err = receiver.Query(ctx, []string{"globex"})
+	assert.NoError(t, err)
+}
+
+func TestProtocolRejectsBadRounds(t *testing.T) {
+	vectorizer := data.NewTfidfVectorizer(2, 1)
+	vectorizer.Fit(corpus)
+	receiver := NewReceiver(hem.InsecureProfile(8, 1), vectorizer)
+	sender := NewSender([]string{"initech"}, hem.SecurityNone)
+
+	_, err := receiver.Keys()
+	assert.True(t, errors.Is(err, ErrOutOfOrder), "Keys before Setup: %v", err)
+	_, err = receiver.Query(context.Background(), []string{"initech"})
+	assert.True(t, errors.Is(err, ErrOutOfOrder), "Query before Keys: %v", err)
+	assert.True(t, errors.Is(sender.HandleKeys(&KeysMessage{}), ErrOutOfOrder))
+
+	setup, err := receiver.Setup()
+	assert.NoError(t, err)
+	_, err = receiver.Setup()
+	assert.True(t, errors.Is(err, ErrOutOfOrder), "Setup twice: %v", err)
+
+	// A message of one round does not decode as another.
+	wire, err := setup.MarshalBinary()
+	assert.NoError(t, err)
+	var keys KeysMessage
+	assert.True(t, errors.Is(keys.UnmarshalBinary(wire), ErrMalformedMessage))
+	var truncated SetupMessage
+	assert.True(t, errors.Is(truncated.UnmarshalBinary(wire[:len(wire)-1]), ErrMalformedMessage))
+
+	// A sender that insists on 128-bit security refuses the toy parameters.
+	strict := NewSender([]string{"initech"}, hem.Security128)
+	assert.Error(t, strict.HandleSetup(setup))
+}
+
+func TestProtocolWithAlphabetVocabulary(t *testing.T) {
+	ctx := context.Background()
+	vectorizer := data.NewTfidfVectorizer(2, 1)
+	assert.NoError(t, vectorizer.FitAlphabet(data.DefaultAlphabet))
+
+	receiver := NewReceiver(hem.InsecureProfile(8, 1), vectorizer)
+	sender := NewSender([]string{"Initech", "Globex Corporation"}, hem.SecurityNone)
+
+	setup, err := receiver.Setup()
+	assert.NoError(t, err)
+	assert.Empty(t, setup.Vocabulary, "Only the alphabet should be sent")
+	var gotSetup SetupMessage
+	transfer(t, setup, &gotSetup)
+	assert.Equal(t, data.DefaultAlphabet, gotSetup.Alphabet)
+	assert.NoError(t, sender.HandleSetup(&gotSetup))
+
+	keys, err := receiver.Keys()
+	assert.NoError(t, err)
+	assert.NoError(t, sender.HandleKeys(keys))
+
+	query, err := receiver.Query(ctx, []string{"initech", "globex corp"})
+	assert.NoError(t, err)
+	answer, err := sender.HandleQuery(ctx, query)
+	assert.NoError(t, err)
+	scores, err := receiver.Scores(ctx, answer)
+	assert.NoError(t, err)
+
+	assert.InDelta(t, 1.0, scores[0][0], 1e-3, "Identical cleaned names should score 1")
+	assert.Greater(t, scores[1][1], scores[1][0], "globex corp should be closest to Globex Corporation")
+}
+
+func TestProtocolWithCombinedAnalyzer(t *testing.T) {
+	ctx := context.Background()
+	vectorizer, err := data.NewTfidfVectorizerRange(data.AnalyzerCombined, 2, 4, 1)
+	assert.NoError(t, err)
+	vectorizer.Phonetics = []data.Phonetic{data.PhoneticDoubleMetaphone}
+	vectorizer.Fit(corpus)
+
+	receiver := NewReceiver(hem.InsecureProfile(10, 1), vectorizer)
+	store := []string{"Initech", "Stark Industries Inc"}
+	sender := NewSender(store, hem.SecurityNone)
+
+	setup, err := receiver.Setup()
+	assert.NoError(t, err)
+	var gotSetup SetupMessage
+	transfer(t, setup, &gotSetup)
+	assert.Equal(t, data.AnalyzerCombined, gotSetup.Analyzer)
+	assert.Equal(t, 2, gotSetup.NgramLength)
+	assert.Equal(t, 4, gotSetup.MaxNgramLength)
+	assert.Equal(t, vectorizer.Phonetics, gotSetup.Phonetics)
+	assert.NoError(t, sender.HandleSetup(&gotSetup))
+
+	keys, err := receiver.Keys()
+	assert.NoError(t, err)
+	assert.NoError(t, sender.HandleKeys(keys))
+
+	queries := []string{"stark industries"}
+	query, err := receiver.Query(ctx, queries)
+	assert.NoError(t, err)
+	answer, err := sender.HandleQuery(ctx, query)
+	assert.NoError(t, err)
+	scores, err := receiver.Scores(ctx, answer)
+	assert.NoError(t, err)
+
+	queryVectors := vectorize(vectorizer, data.DefaultPipeline(), queries)
+	storeVectors := vectorize(vectorizer, data.DefaultPipeline(), store)
+	for j := range store {
+		assert.InDelta(t, utils.DotProduct(queryVectors[0], storeVectors[j]), scores[0][j], 1e-4)
+	}
+	assert.Greater(t, scores[0][1], scores[0][0])
+}
+
+func TestProtocolChecksModel(t *testing.T) {
+	vectorizer := data.NewTfidfVectorizer(2, 1)
+	vectorizer.Fit(corpus)
+	receiver := NewReceiver(hem.InsecureProfile(8, 1), vectorizer)
+	setup, err := receiver.Setup()
+	assert.NoError(t, err)
+
+	// A Sender holding the same model accepts the Receiver.
+	assert.NoError(t, NewSenderWithModel([]string{"initech"}, hem.SecurityNone, vectorizer).HandleSetup(setup))
+
+	// One fitted on another corpus does not.
+	other := data.NewTfidfVectorizer(2, 1)
+	other.Fit(corpus[1:])
+	err = NewSenderWithModel([]string{"initech"}, hem.SecurityNone, other).HandleSetup(setup)
+	assert.True(t, errors.Is(err, ErrModelMismatch), "Different model: %v", err)
+
+	// Neither does a Sender that rebuilds a vocabulary not matching the hash.
+	setup.Vocabulary = setup.Vocabulary[1:]
+	setup.DocFreq = setup.DocFreq[1:]
+	err = NewSender([]string{"initech"}, hem.SecurityNone).HandleSetup(setup)
+	assert.True(t, errors.Is(err, ErrModelMismatch), "Altered vocabulary: %v", err)
+}
+
+func TestProtocolRejectsMalformedCiphertexts(t *testing.T) {
+	ctx := context.Background()
+	vectorizer := data.NewTfidfVectorizer(2, 1)
+	vectorizer.Fit(corpus)
+	receiver := NewReceiver(hem.InsecureProfile(8, 1), vectorizer)
+	sender := NewSender([]string{"initech", "globex"}, hem.SecurityNone)
+	setup, err := receiver.Setup()
+	assert.NoError(t, err)
+	assert.NoError(t, sender.HandleSetup(setup))
+	keys, err := receiver.Keys()
+	assert.NoError(t, err)
+	assert.NoError(t, sender.HandleKeys(keys))
+	_, err = receiver.Query(ctx, []string{"initech"})
+	assert.NoError(t, err)
+
+	deeper, err := hem.InsecureProfile(8, 3).Parameters()
+	assert.NoError(t, err)
+	wider, err := hem.InsecureProfile(9, 1).Parameters()
+	assert.NoError(t, err)
+	forged := map[string]*rlwe.Ciphertext{
+		"degree 2 above the max level": ckks.NewCiphertext(deeper, 2, 3),
+		"above the max level":          ckks.NewCiphertext(deeper, 1, 3),
+		"larger ring":                  ckks.NewCiphertext(wider, 1, 1),
+	}
+	for name, ct := range forged {
+		// Sealed under the parameters of the party it is sent to.
+		wire, err := serialization.MarshalCiphertextMatrix(sender.params, [][]*rlwe.Ciphertext{{ct}})
+		assert.NoError(t, err)
+		_, err = sender.HandleQuery(ctx, &QueryMessage{Queries: wire})
+		assert.True(t, errors.Is(err, ErrMalformedMessage), "Query %s: %v", name, err)
+		_, err = receiver.Scores(ctx, &ScoresMessage{Scores: wire})
+		assert.True(t, errors.Is(err, ErrMalformedMessage), "Scores %s: %v", name, err)
+	}
+}
+
+func TestProtocolRejectsBadDocumentFrequencies(t *testing.T) {
+	vectorizer := data.NewTfidfVectorizer(2, 1)
+	vectorizer.SmoothIDF = false
+	vectorizer.Fit(corpus)
+	receiver := NewReceiver(hem.InsecureProfile(8, 1), vectorizer)
+	setup, err := receiver.Setup()
+	assert.NoError(t, err)
+	assert.NoError(t, NewSender([]string{"initech"}, hem.SecurityNone).HandleSetup(setup))
+
+	// Without smoothing these would turn into infinite or NaN weights.
+	for _, df := range []int{0, -1, setup.NumDocs + 1} {
+		forged := *setup
+		forged.DocFreq = append([]int{df}, setup.DocFreq[1:]...)
+		var got SetupMessage
+		transfer(t, &forged, &got)
+		err := NewSender([]string{"initech"}, hem.SecurityNone).HandleSetup(&got)
+		assert.True(t, errors.Is(err, ErrMalformedMessage), "Document frequency %d: %v", df, err)
+	}
+}
+
+func TestProtocolChecksPipeline(t *testing.T) {
+	vectorizer := data.NewTfidfVectorizer(2, 1)
+	vectorizer.Fit(corpus)
+	config := data.DefaultPipelineConfig()
+	config.Version = "hyphens"
+	config.Steps[1].Punctuation = data.PunctuationSpace
+	pipeline, err := data.NewPipeline(config)
+	assert.NoError(t, err)
+
+	receiver := NewReceiver(hem.InsecureProfile(8, 1), vectorizer)
+	receiver.SetPipeline(pipeline)
+	setup, err := receiver.Setup()
+	assert.NoError(t, err)
+	var got SetupMessage
+	transfer(t, setup, &got)
+	assert.Equal(t, "hyphens", got.PipelineVersion)
+
+	// A Sender cleaning with the default pipeline refuses the Receiver.
+	err = NewSender([]string{"initech"}, hem.SecurityNone).HandleSetup(&got)
+	assert.True(t, errors.Is(err, ErrPipelineMismatch), "Different pipeline: %v", err)
+
+	sender := NewSender([]string{"initech"}, hem.SecurityNone)
+	sender.SetPipeline(pipeline)
+	assert.NoError(t, sender.HandleSetup(&got))
+}
+
+func TestMessagesCarryProtocolVersion(t *testing.T) {
+	vectorizer := data.NewTfidfVectorizer(2, 1)
+	vectorizer.Fit(corpus)
+	setup, err := NewReceiver(hem.InsecureProfile(8, 1), vectorizer).Setup()
+	assert.NoError(t, err)
+	wire, err := setup.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolVersion, binary.BigEndian.Uint16(wire[1:]))
+
+	// A peer on another layout is refused rather than misread.
+	binary.BigEndian.PutUint16(wire[1:], ProtocolVersion+1)
+	var got SetupMessage
+	err = got.UnmarshalBinary(wire)
+	assert.True(t, errors.Is(err, ErrUnsupportedVersion), "Other version: %v", err)
+}
@@ -0,0 +1,106 @@
+package hem
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrNilCiphertext marks a batch entry without a ciphertext, usually
+	// because the vector it stands for failed to encrypt.
+	ErrNilCiphertext = errors.New("nil ciphertext")
+	// ErrVectorTooLong marks a vector with more values than the ring has slots.
+	ErrVectorTooLong = errors.New("vector longer than the slot count")
+)
+
+// IndexError is the failure of a single entry of a batch operation. Col is -1
+// when the operation works on a vector rather than a matrix.
+type IndexError struct {
+	Op       string
+	Row, Col int
+	Err      error
+}
+
+func (e *IndexError) Error() string {
+	if e.Col < 0 {
+		return fmt.Sprintf("%s at %d: %v", e.Op, e.Row, e.Err)
+	}
+	return fmt.Sprintf("%s at (%d,%d): %v", e.Op, e.Row, e.Col, e.Err)
+}
+
+func (e *IndexError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError collects every failed entry of a batch operation, ordered by
+// index. The operation still returns the results of the entries that worked,
+// so a caller can tell the failed cells apart from genuine low scores.
+type BatchError struct {
+	Errors []*IndexError
+}
+
+func (e *BatchError) Error() string {
+	msgs := make([]string, 0, min(len(e.Errors), 3))
+	for _, err := range e.Errors[:cap(msgs)] {
+		msgs = append(msgs, err.Error())
+	}
+	if len(e.Errors) > len(msgs) {
+		msgs = append(msgs, fmt.Sprintf("and %d more", len(e.Errors)-len(msgs)))
+	}
+	return fmt.Sprintf("%d batch entries failed: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Failed reports whether the entry at (row, col) is one of the failures. Use
+// col -1 for vector operations.
+func (e *BatchError) Failed(row, col int) bool {
+	return e.cause(row, col) != nil
+}
+
+func (e *BatchError) cause(row, col int) error {
+	for _, err := range e.Errors {
+		if err.Row == row && err.Col == col {
+			return err.Err
+		}
+	}
+	return nil
+}
+
+// batchErrors gathers the IndexErrors of concurrent workers.
+type batchErrors struct {
+	mu   sync.Mutex
+	errs []*IndexError
+}
+
+func (b *batchErrors) add(op string, row, col int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.errs = append(b.errs, &IndexError{Op: op, Row: row, Col: col, Err: err})
+}
+
+// err returns the collected failures as a *BatchError, or nil if there were
+// none.
+func (b *batchErrors) err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.errs) == 0 {
+		return nil
+	}
+	sort.Slice(b.errs, func(i, j int) bool {
+		if b.errs[i].Row != b.errs[j].Row {
+			return b.errs[i].Row < b.errs[j].Row
+		}
+		return b.errs[i].Col < b.errs[j].Col
+	})
+	return &BatchError{Errors: b.errs}
+}
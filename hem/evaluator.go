@@ -1,79 +1,402 @@
 package hem
 
 import (
+	"context"
 	"fmt"
-	"sync"
+	"math"
+	"math/big"
 
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/serialization"
+	"github.com/tuneinsight/lattigo/v6/circuits/ckks/polynomial"
 	"github.com/tuneinsight/lattigo/v6/core/rlwe"
 	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"github.com/tuneinsight/lattigo/v6/utils/bignum"
 )
 
-type evaluatorContext struct {
+// Shape of the step approximation used by StepThreshold. A degree 63
+// Chebyshev interpolant of 0.5*(1+tanh(12*(x-cutoff))) is within ~0.01 of 0 or
+// 1 once a score is 0.2 away from the cutoff. The interval leaves room for
+// the partial sums in the unused slots of a packed result, which can exceed 1.
+const (
+	stepDegree    = 63
+	stepSharpness = 12.0
+	stepInterval  = 1.5
+)
+
+// StepThresholdLevels is the number of levels StepThreshold consumes: one to
+// rescale the DotProduct output, one for the change of basis and
+// bits.Len(63) = 6 for the degree 63 polynomial. The Deep profiles provide
+// exactly this many.
+const StepThresholdLevels = 8
+
+// EvaluatorContext computes encrypted similarity scores from encrypted queries
+// and plaintext store vectors. It holds evaluation keys only and cannot
+// decrypt anything.
+type EvaluatorContext struct {
+	// Workers bounds the goroutines of batch operations; 0 means GOMAXPROCS.
+	Workers int
+	// Weights, if set, scales slot k of every store vector by Weights[k]
+	// before it is multiplied with a query. For queries that concatenate
+	// several unit-length fields, such as data.EntityVectorizer builds, the
+	// score becomes the weighted sum of the per-field similarities. Slots
+	// beyond Weights keep weight 1.
+	Weights []float64
 	params *ckks.Parameters
 	encoder *ckks.Encoder
 	evaluator *ckks.Evaluator
 }
 
-func (ec *evaluatorContext) ShallowCopy() *evaluatorContext {
-    return &evaluatorContext{
+// NewEvaluatorContext builds an evaluator from the key owner's evaluation
+// keys. gks must cover galoisElements(params), as GenerateContexts does.
+func NewEvaluatorContext(params ckks.Parameters, rlk *rlwe.RelinearizationKey, gks []*rlwe.GaloisKey) *EvaluatorContext {
+	return &EvaluatorContext{
+		params:    &params,
+		encoder:   ckks.NewEncoder(params),
+		evaluator: ckks.NewEvaluator(params, rlwe.NewMemEvaluationKeySet(rlk, gks...)),
+	}
+}
+
+// NewEvaluatorFromBytes builds an evaluator from serialized parameters,
+// relinearization key and Galois keys.
+func NewEvaluatorFromBytes(paramsData, rlkData, gksData []byte) (*EvaluatorContext, error) {
+	params, err := serialization.UnmarshalParameters(paramsData)
+	if err != nil {
+		return nil, err
+	}
+	rlk, err := serialization.UnmarshalRelinearizationKey(params, rlkData)
+	if err != nil {
+		return nil, err
+	}
+	gks, err := serialization.UnmarshalGaloisKeys(params, gksData)
+	if err != nil {
+		return nil, err
+	}
+	return NewEvaluatorContext(params, rlk, gks), nil
+}
+
+func (ec *EvaluatorContext) ShallowCopy() *EvaluatorContext {
+    return &EvaluatorContext{
+        Workers:   ec.Workers,
+        Weights:   ec.Weights,
         params:    ec.params,            // Params can be shared safely
         encoder:   ec.encoder.ShallowCopy(),
         evaluator: ec.evaluator.ShallowCopy(),
     }
 }
 
-func (ec *evaluatorContext) DotProduct(ct *rlwe.Ciphertext,pt_vector rlwe.Operand, output *rlwe.Ciphertext ) (error) {
-	err := ec.evaluator.MulRelin(ct, pt_vector, output)
-	ec.evaluator.InnerSum(output,1,ec.params.MaxSlots(),output)
-	return err
-}
-
-func (ec *evaluatorContext)BatchDotProduct(ct_matrix []*rlwe.Ciphertext, pt_matrix [][]float64) ([][]*rlwe.Ciphertext, error) {
-    // Initialize the result matrix
-    numRows := len(ct_matrix)
-    numCols := len(pt_matrix)
-    results := make([][]*rlwe.Ciphertext, numRows)
-    
-    // Proper initialization of the results matrix with pre-allocated ciphertexts
-    for i := 0; i < numRows; i++ {
-        results[i] = make([]*rlwe.Ciphertext, numCols)
-        for j := 0; j < numCols; j++ {
-            results[i][j] = ckks.NewCiphertext(*ec.params, ec.params.MaxSlots(), ec.params.MaxLevel())
-        }
-    }
-    // Use a WaitGroup to synchronize goroutines
-    var wg sync.WaitGroup
-    // Channel for collecting errors
-    errChan := make(chan error, numRows*numCols)
-    
-    // Process each ciphertext against each plaintext vector
-    for i := range ct_matrix {
-        for j := range pt_matrix {
-            wg.Add(1)
-            go func(rowIdx int, colIdx int) {
-                defer wg.Done()
-                // Skip if ciphertext is nil
-                if ct_matrix[rowIdx] == nil {
-                    results[rowIdx][colIdx] = nil
-                    return
-                }
-                localEC := ec.ShallowCopy()
-                // Compute the dot product
-                err := localEC.DotProduct(ct_matrix[rowIdx], pt_matrix[colIdx],results[rowIdx][colIdx])
-                if err != nil {
-                    errChan <- fmt.Errorf("dot product error at (%d,%d): %v", rowIdx, colIdx, err)
-                    return
-                }
-            }(i, j)
-        }
-    }
-    // Wait for all goroutines to complete
-    wg.Wait()
-    close(errChan)
-    // Check for errors
-    if len(errChan) > 0 {
-        // Return the first error encountered
-        return results, <-errChan
-    }
-    return results, nil
-}
\ No newline at end of file
+func (ec *EvaluatorContext) DotProduct(ct *rlwe.Ciphertext, pt_vector rlwe.Operand, output *rlwe.Ciphertext) error {
+	if err := ec.evaluator.MulRelin(ct, pt_vector, output); err != nil {
+		return err
+	}
+	return ec.evaluator.InnerSum(output, 1, ec.params.MaxSlots(), output)
+}
+
+// DotProductResult is one cell of a StreamDotProduct.
+type DotProductResult struct {
+	Row, Col   int
+	Ciphertext *rlwe.Ciphertext
+	Err        error
+}
+
+// StreamDotProduct computes the cells of BatchDotProduct on at most Workers
+// goroutines and sends each one as soon as it is ready, in no particular
+// order, so the caller can decrypt and drop results instead of holding the
+// whole matrix. Rows with a nil query are skipped. The channel is closed once
+// every cell was sent or ctx is done; check ctx.Err() to tell the two apart.
+func (ec *EvaluatorContext) StreamDotProduct(ctx context.Context, ct_matrix []*rlwe.Ciphertext, pt_matrix [][]float64) (<-chan DotProductResult, error) {
+	for j, vector := range pt_matrix {
+		if len(vector) > ec.params.MaxSlots() {
+			return nil, &IndexError{Op: "store vector", Row: j, Col: -1, Err: fmt.Errorf("%w: %d values, %d slots", ErrVectorTooLong, len(vector), ec.params.MaxSlots())}
+		}
+	}
+	pt_matrix = ec.weighted(pt_matrix)
+	numCols := len(pt_matrix)
+	workers := workerCount(ec.Workers)
+	out := make(chan DotProductResult, workers)
+	go func() {
+		defer close(out)
+		forEach(ctx, workers, len(ct_matrix)*numCols, func() func(int) {
+			localEC := ec.ShallowCopy()
+			return func(cell int) {
+				rowIdx, colIdx := cell/numCols, cell%numCols
+				if ct_matrix[rowIdx] == nil {
+					return
+				}
+				// Allocated here rather than up front, so only the cells in
+				// flight and those the caller keeps are held in memory.
+				result := DotProductResult{Row: rowIdx, Col: colIdx}
+				output := ckks.NewCiphertext(*ec.params, 1, ct_matrix[rowIdx].Level())
+				if err := localEC.DotProduct(ct_matrix[rowIdx], pt_matrix[colIdx], output); err != nil {
+					result.Err = err
+				} else {
+					result.Ciphertext = output
+				}
+				select {
+				case out <- result:
+				case <-ctx.Done():
+				}
+			}
+		})
+	}()
+	return out, nil
+}
+
+// weighted returns the store vectors scaled by Weights, or pt_matrix itself
+// if there are none. The caller's vectors are left untouched.
+func (ec *EvaluatorContext) weighted(pt_matrix [][]float64) [][]float64 {
+	if len(ec.Weights) == 0 {
+		return pt_matrix
+	}
+	scaled := make([][]float64, len(pt_matrix))
+	for j, vector := range pt_matrix {
+		scaled[j] = make([]float64, len(vector))
+		for k, x := range vector {
+			if k < len(ec.Weights) {
+				x *= ec.Weights[k]
+			}
+			scaled[j][k] = x
+		}
+	}
+	return scaled
+}
+
+// BatchDotProduct computes the dot product of every query with every store
+// vector, one ciphertext per cell, applying Weights if set. Failed cells are left nil and reported in
+// the returned *BatchError. If ctx is cancelled the remaining cells are left
+// nil and ctx.Err() is returned. Use StreamDotProduct for large matrices.
+func (ec *EvaluatorContext) BatchDotProduct(ctx context.Context, ct_matrix []*rlwe.Ciphertext, pt_matrix [][]float64) ([][]*rlwe.Ciphertext, error) {
+	stream, err := ec.StreamDotProduct(ctx, ct_matrix, pt_matrix)
+	if err != nil {
+		return nil, err
+	}
+	results := make([][]*rlwe.Ciphertext, len(ct_matrix))
+	for i := range results {
+		results[i] = make([]*rlwe.Ciphertext, len(pt_matrix))
+	}
+	var errs batchErrors
+	for cell := range stream {
+		if cell.Err != nil {
+			errs.add("dot product", cell.Row, cell.Col, cell.Err)
+			continue
+		}
+		results[cell.Row][cell.Col] = cell.Ciphertext
+	}
+	if err := ctx.Err(); err != nil {
+		return results, err
+	}
+	return results, errs.err()
+}
+
+// PackedScores is the result of BatchDotProductPacked. Row i holds the scores
+// of query i against all NumScores store vectors, packed BlockSize slots apart
+// so that a single ciphertext carries MaxSlots/BlockSize of them.
+type PackedScores struct {
+	Ciphertexts [][]*rlwe.Ciphertext
+	BlockSize   int
+	NumScores   int
+}
+
+// ScoresPerCiphertext returns how many scores share one ciphertext.
+func (ps *PackedScores) ScoresPerCiphertext(maxSlots int) int {
+	return maxSlots / ps.BlockSize
+}
+
+// packingBlockSize returns the smallest power of two that holds a vector of
+// length dim. InnerSum and Replicate only work on power-of-two blocks.
+func (ec *EvaluatorContext) packingBlockSize(dim int) (int, error) {
+	if dim > ec.params.MaxSlots() {
+		return 0, fmt.Errorf("vector length %d exceeds the %d available slots", dim, ec.params.MaxSlots())
+	}
+	blockSize := 1
+	for blockSize < dim {
+		blockSize <<= 1
+	}
+	return blockSize, nil
+}
+
+// ReplicateQuery copies the first blockSize slots of ct into every block of
+// the ciphertext. ct must be zero beyond its first block, which is the case
+// for anything BatchEncrypt produced from a vector of at most blockSize values.
+func (ec *EvaluatorContext) ReplicateQuery(ct *rlwe.Ciphertext, blockSize int) (*rlwe.Ciphertext, error) {
+	out := ckks.NewCiphertext(*ec.params, ct.Degree(), ct.Level())
+	if err := ec.evaluator.Replicate(ct, blockSize, ec.params.MaxSlots()/blockSize, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PackedDotProduct multiplies a replicated query with store vectors laid out
+// side by side in pt_packed and sums every block, leaving the score of the
+// k-th store vector in slot k*blockSize of output.
+func (ec *EvaluatorContext) PackedDotProduct(replicated *rlwe.Ciphertext, pt_packed []float64, blockSize int, output *rlwe.Ciphertext) error {
+	if err := ec.evaluator.MulRelin(replicated, pt_packed, output); err != nil {
+		return err
+	}
+	return ec.evaluator.InnerSum(output, 1, blockSize, output)
+}
+
+// BatchDotProductPacked is the slot-packed counterpart of BatchDotProduct.
+// Instead of one ciphertext per query/store pair it returns one ciphertext per
+// MaxSlots/BlockSize store vectors, so small vectors no longer waste most of
+// the slots. Use CosineSimMatrixDecryptPacked to read the scores back. Like
+// BatchDotProduct it applies Weights and runs on at most Workers goroutines and stops when ctx is
+// done.
+func (ec *EvaluatorContext) BatchDotProductPacked(ctx context.Context, ct_matrix []*rlwe.Ciphertext, pt_matrix [][]float64) (*PackedScores, error) {
+	dim := 0
+	for _, v := range pt_matrix {
+		dim = max(dim, len(v))
+	}
+	blockSize, err := ec.packingBlockSize(dim)
+	if err != nil {
+		return nil, err
+	}
+	perCt := ec.params.MaxSlots() / blockSize
+	numCts := (len(pt_matrix) + perCt - 1) / perCt
+
+	// Lay the store vectors out once; every query reuses the same plaintexts.
+	pt_matrix = ec.weighted(pt_matrix)
+	packed := make([][]float64, numCts)
+	for c := range packed {
+		packed[c] = make([]float64, ec.params.MaxSlots())
+		for k := 0; k < perCt && c*perCt+k < len(pt_matrix); k++ {
+			copy(packed[c][k*blockSize:], pt_matrix[c*perCt+k])
+		}
+	}
+
+	results := &PackedScores{
+		Ciphertexts: make([][]*rlwe.Ciphertext, len(ct_matrix)),
+		BlockSize:   blockSize,
+		NumScores:   len(pt_matrix),
+	}
+	var errs batchErrors
+
+	for i := range results.Ciphertexts {
+		results.Ciphertexts[i] = make([]*rlwe.Ciphertext, numCts)
+	}
+
+	// Replicate every query once, then multiply it with each packed plaintext.
+	replicated := make([]*rlwe.Ciphertext, len(ct_matrix))
+	err = forEach(ctx, ec.Workers, len(ct_matrix), func() func(int) {
+		localEC := ec.ShallowCopy()
+		return func(rowIdx int) {
+			if ct_matrix[rowIdx] == nil {
+				return
+			}
+			ct, err := localEC.ReplicateQuery(ct_matrix[rowIdx], blockSize)
+			if err != nil {
+				errs.add("replicate", rowIdx, -1, err)
+				return
+			}
+			replicated[rowIdx] = ct
+		}
+	})
+	if err != nil {
+		return results, err
+	}
+
+	err = forEach(ctx, ec.Workers, len(ct_matrix)*numCts, func() func(int) {
+		localEC := ec.ShallowCopy()
+		return func(cell int) {
+			rowIdx, ctIdx := cell/numCts, cell%numCts
+			if replicated[rowIdx] == nil {
+				return
+			}
+			output := ckks.NewCiphertext(*ec.params, 1, replicated[rowIdx].Level())
+			if err := localEC.PackedDotProduct(replicated[rowIdx], packed[ctIdx], blockSize, output); err != nil {
+				errs.add("packed dot product", rowIdx, ctIdx, err)
+				return
+			}
+			results.Ciphertexts[rowIdx][ctIdx] = output
+		}
+	})
+	if err != nil {
+		return results, err
+	}
+	return results, errs.err()
+}
+
+
+// stepPolynomial approximates the step function at cutoff on
+// [-stepInterval, stepInterval]. An approximation on n nodes has degree n,
+// so stepDegree nodes give a polynomial of exactly stepDegree.
+func stepPolynomial(cutoff float64) polynomial.Polynomial {
+	var prec uint = 128
+	step := func(x *big.Float) *big.Float {
+		xF64, _ := x.Float64()
+		y := 0.5 * (1 + math.Tanh(stepSharpness*(xF64-cutoff)))
+		return new(big.Float).SetPrec(prec).SetFloat64(y)
+	}
+	interval := bignum.Interval{
+		A:     *bignum.NewFloat(-stepInterval, prec),
+		B:     *bignum.NewFloat(stepInterval, prec),
+		Nodes: stepDegree,
+	}
+	return polynomial.NewPolynomial(bignum.ChebyshevApproximation(step, interval))
+}
+
+// StepThreshold turns a DotProduct output into an encrypted match indicator:
+// after decryption every score at or above cutoff reads (close to) 1 and every
+// score below reads (close to) 0, so the decryptor learns which store entries
+// matched but not how similar the others were.
+func (ec *EvaluatorContext) StepThreshold(ct *rlwe.Ciphertext, cutoff float64) (*rlwe.Ciphertext, error) {
+	return ec.stepThreshold(ct, stepPolynomial(cutoff))
+}
+
+func (ec *EvaluatorContext) stepThreshold(ct *rlwe.Ciphertext, poly polynomial.Polynomial) (*rlwe.Ciphertext, error) {
+	if ct.Level() < StepThresholdLevels {
+		return nil, fmt.Errorf("ciphertext at level %d, StepThreshold needs %d", ct.Level(), StepThresholdLevels)
+	}
+	out := ct.CopyNew()
+	if err := ec.evaluator.Rescale(out, out); err != nil {
+		return nil, err
+	}
+
+	// Map the approximation interval onto [-1, 1] for the Chebyshev basis.
+	scalar, constant := poly.ChangeOfBasis()
+	if err := ec.evaluator.Mul(out, scalar, out); err != nil {
+		return nil, err
+	}
+	if err := ec.evaluator.Add(out, constant, out); err != nil {
+		return nil, err
+	}
+	if err := ec.evaluator.Rescale(out, out); err != nil {
+		return nil, err
+	}
+	return polynomial.NewEvaluator(*ec.params, ec.evaluator).Evaluate(out, poly, ec.params.DefaultScale())
+}
+
+// BatchStepThreshold applies StepThreshold to every cell of a BatchDotProduct
+// or BatchDotProductPacked result, on at most Workers goroutines. Cancelling
+// ctx stops it and returns ctx.Err().
+func (ec *EvaluatorContext) BatchStepThreshold(ctx context.Context, ct_matrix [][]*rlwe.Ciphertext, cutoff float64) ([][]*rlwe.Ciphertext, error) {
+	poly := stepPolynomial(cutoff)
+	results := make([][]*rlwe.Ciphertext, len(ct_matrix))
+	type cell struct{ row, col int }
+	var cells []cell
+	for i := range ct_matrix {
+		results[i] = make([]*rlwe.Ciphertext, len(ct_matrix[i]))
+		for j := range ct_matrix[i] {
+			if ct_matrix[i][j] != nil {
+				cells = append(cells, cell{i, j})
+			}
+		}
+	}
+
+	var errs batchErrors
+	err := forEach(ctx, ec.Workers, len(cells), func() func(int) {
+		localEC := ec.ShallowCopy()
+		return func(k int) {
+			rowIdx, colIdx := cells[k].row, cells[k].col
+			out, err := localEC.stepThreshold(ct_matrix[rowIdx][colIdx], poly)
+			if err != nil {
+				errs.add("step threshold", rowIdx, colIdx, err)
+				return
+			}
+			results[rowIdx][colIdx] = out
+		}
+	})
+	if err != nil {
+		return results, err
+	}
+	return results, errs.err()
+}
@@ -1,24 +1,31 @@
 package hem
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math"
+	"math/bits"
 	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/compression"
 	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/data"
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/serialization"
 	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/utils"
 	"github.com/mjibson/go-dsp/fft"
 	"github.com/stretchr/testify/assert"
 	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/multiparty"
 	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
 )
 
 func TestEncryptDecryptCycle(t *testing.T) {
-	encCtx, decCtx, _ := GenerateContexts(8)
+	encCtx, decCtx, _, _ := GenerateContexts(InsecureProfile(8, 2))
 	testVector := []float64{0.5, 0.25, -0.75, 1.0}
 
 	plaintext := ckks.NewPlaintext(*encCtx.params, encCtx.params.MaxLevel())
@@ -40,7 +47,7 @@ func TestEncryptDecryptCycle(t *testing.T) {
 
 func TestBatchEncryptDecryptCycle(t *testing.T) {
 	// Initialize contexts with reasonable parameters
-	encCtx, decCtx, _ := GenerateContexts(8)
+	encCtx, decCtx, _, _ := GenerateContexts(InsecureProfile(8, 2))
 
 	// Prepare multiple test vectors of different sizes
 	numVectors := 100
@@ -51,14 +58,16 @@ func TestBatchEncryptDecryptCycle(t *testing.T) {
 	}
 
 	// Encrypt all vectors in batch
-	encryptedVectors := encCtx.BatchEncrypt(testVectors)
+	encryptedVectors, err := encCtx.BatchEncrypt(context.Background(), testVectors)
+	assert.NoError(t, err)
 
 	// Verify the number of encrypted vectors matches the input
 	assert.Equal(t, len(testVectors), len(encryptedVectors),
 		"Number of encrypted vectors should match input count")
 
 	// Decrypt all vectors in batch
-	decryptedVectors := decCtx.BatchDecrypt(encryptedVectors)
+	decryptedVectors, err := decCtx.BatchDecrypt(context.Background(), encryptedVectors)
+	assert.NoError(t, err)
 
 	// Verify the number of decrypted vectors matches
 	assert.Equal(t, len(testVectors), len(decryptedVectors),
@@ -82,10 +91,12 @@ func TestBatchEncryptDecryptCycle(t *testing.T) {
 
 	// Empty batch case
 	emptyVectors := [][]float64{}
-	emptyEncrypted := encCtx.BatchEncrypt(emptyVectors)
+	emptyEncrypted, err := encCtx.BatchEncrypt(context.Background(), emptyVectors)
+	assert.NoError(t, err)
 	assert.Empty(t, emptyEncrypted, "Empty input should produce empty encrypted result")
 
-	emptyDecrypted := decCtx.BatchDecrypt(emptyEncrypted)
+	emptyDecrypted, err := decCtx.BatchDecrypt(context.Background(), emptyEncrypted)
+	assert.NoError(t, err)
 	assert.Empty(t, emptyDecrypted, "Empty encrypted input should produce empty decrypted result")
 
 	// Mixed nil case
@@ -94,15 +105,22 @@ func TestBatchEncryptDecryptCycle(t *testing.T) {
 	mixedVectors[1] = nil                 // Nil
 	mixedVectors[2] = encryptedVectors[1] // Valid
 
-	mixedDecrypted := decCtx.BatchDecrypt(mixedVectors)
+	mixedDecrypted, err := decCtx.BatchDecrypt(context.Background(), mixedVectors)
 	assert.Equal(t, 3, len(mixedDecrypted), "Should have 3 results for 3 inputs")
 	assert.NotNil(t, mixedDecrypted[0], "First result should not be nil")
 	assert.Nil(t, mixedDecrypted[1], "Second result should be nil")
 	assert.NotNil(t, mixedDecrypted[2], "Third result should not be nil")
+
+	// The nil entry is reported by index.
+	var batchErr *BatchError
+	assert.True(t, errors.As(err, &batchErr), "Expected a *BatchError, got %v", err)
+	assert.Equal(t, 1, len(batchErr.Errors))
+	assert.True(t, batchErr.Failed(1, -1), "Index 1 should be reported")
+	assert.True(t, errors.Is(err, ErrNilCiphertext))
 }
 
 func TestCosineSimilarity(t *testing.T) {
-	encCtx, decCtx, evalCtx := GenerateContexts(8)
+	encCtx, decCtx, evalCtx, _ := GenerateContexts(InsecureProfile(8, 2))
 
 	normalized_a := utils.GenerateTestVector(5)
 	normalized_b := utils.GenerateTestVector(5)
@@ -136,7 +154,7 @@ func TestCosineSimilarity(t *testing.T) {
 
 func TestBatchCosineSimilarity(t *testing.T) {
 	// Initialize contexts
-	encCtx, decCtx, evalCtx := GenerateContexts(8)
+	encCtx, decCtx, evalCtx, _ := GenerateContexts(InsecureProfile(8, 2))
 	// Create test vectors for ciphertexts
 	numCtVectors := 1
 	vectorSize := 100
@@ -164,15 +182,17 @@ func TestBatchCosineSimilarity(t *testing.T) {
 	}
 	log.Println("Expected cosine similarities:", expectedSims)
 
-	encryptedVectors := encCtx.BatchEncrypt(ctVectors)
+	encryptedVectors, err := encCtx.BatchEncrypt(context.Background(), ctVectors)
+	assert.NoError(t, err)
 
-	resultMatrix, err := evalCtx.BatchDotProduct(encryptedVectors, ptVectors)
+	resultMatrix, err := evalCtx.BatchDotProduct(context.Background(), encryptedVectors, ptVectors)
 	assert.NoError(t, err, "Batch dot product failed")
 
 	// Verify each result
 	for i := range resultMatrix {
 		// Decrypt a batch of results (an entire row of the result matrix)
-		decryptedBatch := decCtx.BatchDecrypt(resultMatrix[i])
+		decryptedBatch, err := decCtx.BatchDecrypt(context.Background(), resultMatrix[i])
+		assert.NoError(t, err)
 
 		// Verify each cosine similarity value
 		for j := range decryptedBatch {
@@ -233,13 +253,14 @@ func TestWithNamesWithoutCompression(t *testing.T) {
 	}
 
 	// Encrypt the query vector
-	encCtx, decCtx, evalCtx := GenerateContexts(10)
+	encCtx, decCtx, evalCtx, _ := GenerateContexts(InsecureProfile(10, 2))
 
 	// Batch encrypt the query vector
-	encryptedQuery := encCtx.BatchEncrypt(queryVectors)
+	encryptedQuery, err := encCtx.BatchEncrypt(context.Background(), queryVectors)
+	assert.NoError(t, err)
 
 	// Compute cosine similarities using HE
-	resultMatrix, err := evalCtx.BatchDotProduct(encryptedQuery, storeVectors)
+	resultMatrix, err := evalCtx.BatchDotProduct(context.Background(), encryptedQuery, storeVectors)
 	if err != nil {
 		t.Fatalf("Error computing batch dot product: %v", err)
 	}
@@ -252,7 +273,8 @@ func TestWithNamesWithoutCompression(t *testing.T) {
 	log.Println("\nHE-computed Cosine Similarity Matrix:")
 	for i := range resultMatrix {
 		// Each row contains similarities between query and all store vectors
-		decryptedBatch := decCtx.BatchDecrypt(resultMatrix[i])
+		decryptedBatch, err := decCtx.BatchDecrypt(context.Background(), resultMatrix[i])
+		assert.NoError(t, err)
 
 		log.Printf("Similarities for query '%s':", query)
 		for j, storeName := range store {
@@ -313,7 +335,8 @@ func TestWithNamesWithoutCompression(t *testing.T) {
 	bestMatch := ""
 	bestScore := -1.0
 
-	decryptedBatch := decCtx.BatchDecrypt(resultMatrix[0])
+	decryptedBatch, err := decCtx.BatchDecrypt(context.Background(), resultMatrix[0])
+	assert.NoError(t, err)
 	for j, storeName := range store {
 		if decryptedBatch[j] != nil && decryptedBatch[j][0] > bestScore {
 			bestScore = decryptedBatch[j][0]
@@ -398,13 +421,14 @@ func TestWithNamesWithCompression(t *testing.T) {
     queryVectors[0] = queryCompressed
     
     // Initialize encryption contexts
-    encCtx, decCtx, evalCtx := GenerateContexts(10)
+    encCtx, decCtx, evalCtx, _ := GenerateContexts(InsecureProfile(10, 2))
     
     // Batch encrypt the compressed query vector
-    encryptedQuery := encCtx.BatchEncrypt(queryVectors)
+    encryptedQuery, err := encCtx.BatchEncrypt(context.Background(), queryVectors)
+    assert.NoError(t, err)
     
     // Compute cosine similarities using HE
-    resultMatrix, err := evalCtx.BatchDotProduct(encryptedQuery, storeCompressed)
+    resultMatrix, err := evalCtx.BatchDotProduct(context.Background(), encryptedQuery, storeCompressed)
     if err != nil {
         t.Fatalf("Error computing batch dot product: %v", err)
     }
@@ -415,7 +439,8 @@ func TestWithNamesWithCompression(t *testing.T) {
     
     // Decrypt the results
     log.Println("\nHE-computed Cosine Similarity Matrix (with compression):")
-    decryptedBatch := decCtx.BatchDecrypt(resultMatrix[0])
+    decryptedBatch, err := decCtx.BatchDecrypt(context.Background(), resultMatrix[0])
+    assert.NoError(t, err)
     
     log.Printf("Similarities for query '%s':", query)
     for j, storeName := range store {
@@ -469,4 +494,514 @@ func TestWithNamesWithCompression(t *testing.T) {
         log.Printf("%-15s | %-12.6f | %-15.6f | %-15.6f", 
             name, originalSim, compressedSim, diff)
     }
-}
\ No newline at end of file
+}
+func TestThresholdDecryption(t *testing.T) {
+	nParties, threshold := 3, 2
+	encCtx, evalCtx, decCtx, parties, err := GenerateThresholdContexts(InsecureProfile(8, 2), nParties, threshold, []byte("fpsi-test-crs"))
+	assert.NoError(t, err, "Threshold key generation failed")
+	assert.Len(t, parties, nParties)
+
+	query := utils.GenerateTestVector(50)
+	utils.NormalizeVector(&query)
+	store := make([][]float64, 4)
+	for i := range store {
+		store[i] = utils.GenerateTestVector(50)
+		utils.NormalizeVector(&store[i])
+	}
+
+	encryptedQuery, err := encCtx.BatchEncrypt(context.Background(), [][]float64{query})
+	assert.NoError(t, err)
+	resultMatrix, err := evalCtx.BatchDotProduct(context.Background(), encryptedQuery, store)
+	assert.NoError(t, err, "Batch dot product failed")
+
+	// Any two of the three parties can open the scores.
+	for _, active := range [][]*ThresholdParty{{parties[0], parties[1]}, {parties[2], parties[0]}} {
+		sims, err := decCtx.CosineSimMatrixDecrypt(resultMatrix, active)
+		assert.NoError(t, err, "Threshold decryption failed")
+		for j := range store {
+			assert.InDelta(t, utils.DotProduct(query, store[j]), sims[0][j], 1e-4,
+				"Cosine similarity mismatch at %d with parties %d,%d", j, active[0].ID, active[1].ID)
+		}
+	}
+
+	// A single party is below the threshold.
+	_, err = decCtx.CosineSimMatrixDecrypt(resultMatrix, parties[:1])
+	assert.Error(t, err, "Decryption should fail below the threshold")
+
+	ct := resultMatrix[0][0]
+	ids := []multiparty.ShamirPublicPoint{parties[0].ID, parties[1].ID}
+	share, err := parties[0].DecryptionShare(ct, ids)
+	assert.NoError(t, err)
+	_, err = decCtx.Decrypt(ct, []DecryptionShare{share})
+	assert.Error(t, err, "Decrypt should refuse fewer than Threshold shares")
+
+	_, err = parties[2].DecryptionShare(ct, ids)
+	assert.Error(t, err, "Party outside the active set should not produce a share")
+
+	// Shares only combine within the active set they were computed for.
+	want := utils.DotProduct(query, store[0])
+	share1, err := parties[1].DecryptionShare(ct, ids)
+	assert.NoError(t, err)
+	decoded, err := decCtx.Decrypt(ct, []DecryptionShare{share1, share})
+	assert.NoError(t, err)
+	assert.InDelta(t, want, decoded[0], 1e-4)
+
+	otherIDs := []multiparty.ShamirPublicPoint{parties[1].ID, parties[2].ID}
+	otherShare1, err := parties[1].DecryptionShare(ct, otherIDs)
+	assert.NoError(t, err)
+	_, err = decCtx.Decrypt(ct, []DecryptionShare{share, otherShare1})
+	assert.Error(t, err, "Shares of different active sets should not combine")
+	_, err = decCtx.Decrypt(ct, []DecryptionShare{share, share})
+	assert.Error(t, err, "A repeated share should be refused")
+
+	// Any other number of active parties cannot decrypt.
+	all := []multiparty.ShamirPublicPoint{parties[0].ID, parties[1].ID, parties[2].ID}
+	_, err = parties[0].DecryptionShare(ct, all)
+	assert.Error(t, err, "An active set larger than the threshold")
+	_, err = parties[0].DecryptionShare(ct, []multiparty.ShamirPublicPoint{parties[0].ID, parties[0].ID})
+	assert.Error(t, err, "An active set with a repeated party")
+	forged := share
+	forged.Active = all
+	_, err = decCtx.Decrypt(ct, []DecryptionShare{forged, share1, share1})
+	assert.Error(t, err, "Shares claiming a larger active set")
+}
+
+func TestThresholdContextsValidation(t *testing.T) {
+	_, _, _, _, err := GenerateThresholdContexts(InsecureProfile(8, 2), 1, 1, []byte("crs"))
+	assert.Error(t, err, "A single party is not a threshold setup")
+	_, _, _, _, err = GenerateThresholdContexts(InsecureProfile(8, 2), 3, 4, []byte("crs"))
+	assert.Error(t, err, "Threshold cannot exceed the number of parties")
+}
+
+func TestPublicKeyEncryptor(t *testing.T) {
+	_, decCtx, evalCtx, _ := GenerateContexts(InsecureProfile(8, 2))
+
+	// The querier only receives the parameters and the public key.
+	queryCtx := NewEncryptorContext(decCtx.Params(), decCtx.PublicKey())
+	assert.Nil(t, queryCtx.rlk, "Querier should not hold evaluation keys")
+
+	query := utils.GenerateTestVector(64)
+	store := utils.GenerateTestVector(64)
+	utils.NormalizeVector(&query)
+	utils.NormalizeVector(&store)
+
+	encrypted, err := queryCtx.BatchEncrypt(context.Background(), [][]float64{query})
+	assert.NoError(t, err)
+	decrypted, err := decCtx.BatchDecrypt(context.Background(), encrypted)
+	assert.NoError(t, err)
+	assert.InDeltaSlice(t, query, decrypted[0][:len(query)], 1e-4, "Public-key encryption round trip failed")
+
+	resultMatrix, err := evalCtx.BatchDotProduct(context.Background(), encrypted, [][]float64{store})
+	assert.NoError(t, err)
+	sims, err := decCtx.CosineSimMatrixDecrypt(context.Background(), resultMatrix)
+	assert.NoError(t, err)
+	assert.InDelta(t, utils.DotProduct(query, store), sims[0][0], 1e-4)
+}
+
+func TestPackedBatchCosineSimilarity(t *testing.T) {
+	encCtx, decCtx, evalCtx, _ := GenerateContexts(InsecureProfile(8, 2))
+
+	queries := make([][]float64, 2)
+	for i := range queries {
+		queries[i] = utils.GenerateTestVector(50)
+		utils.NormalizeVector(&queries[i])
+	}
+	store := make([][]float64, 10)
+	for i := range store {
+		store[i] = utils.GenerateTestVector(50)
+		utils.NormalizeVector(&store[i])
+	}
+
+	encryptedQueries, err := encCtx.BatchEncrypt(context.Background(), queries)
+	assert.NoError(t, err)
+	packed, err := evalCtx.BatchDotProductPacked(context.Background(), encryptedQueries, store)
+	assert.NoError(t, err, "Packed batch dot product failed")
+
+	// 50-dim vectors go into 64-slot blocks, four to a 256-slot ciphertext.
+	assert.Equal(t, 64, packed.BlockSize)
+	assert.Equal(t, 3, len(packed.Ciphertexts[0]), "10 store vectors should need 3 ciphertexts")
+
+	sims, err := decCtx.CosineSimMatrixDecryptPacked(context.Background(), packed)
+	assert.NoError(t, err)
+	for i := range queries {
+		assert.Equal(t, len(store), len(sims[i]))
+		for j := range store {
+			assert.InDelta(t, utils.DotProduct(queries[i], store[j]), sims[i][j], 1e-4,
+				"Packed cosine similarity mismatch at (%d,%d)", i, j)
+		}
+	}
+
+	_, err = evalCtx.BatchDotProductPacked(context.Background(), encryptedQueries, [][]float64{utils.GenerateTestVector(300)})
+	assert.Error(t, err, "Vectors longer than MaxSlots cannot be packed")
+}
+
+func TestStepThreshold(t *testing.T) {
+	encCtx, decCtx, evalCtx, _ := GenerateContexts(InsecureProfile(8, StepThresholdLevels))
+	cutoff := 0.7
+
+	// The polynomial needs no more levels than its degree implies.
+	poly := stepPolynomial(cutoff)
+	assert.Equal(t, stepDegree, poly.Degree())
+	assert.Equal(t, bits.Len(stepDegree), poly.Depth())
+	assert.Equal(t, 2+poly.Depth(), StepThresholdLevels)
+
+	query := utils.GenerateTestVector(40)
+	utils.NormalizeVector(&query)
+	other := utils.GenerateTestVector(40)
+	utils.NormalizeVector(&other)
+
+	// Store vectors at known similarities: identical, opposite, unrelated and
+	// a blend that sits well above the cutoff.
+	negated := make([]float64, len(query))
+	blend := make([]float64, len(query))
+	for i := range query {
+		negated[i] = -query[i]
+		blend[i] = 0.9*query[i] + 0.1*other[i]
+	}
+	utils.NormalizeVector(&blend)
+	store := [][]float64{query, negated, other, blend}
+
+	encryptedQuery, err := encCtx.BatchEncrypt(context.Background(), [][]float64{query})
+	assert.NoError(t, err)
+	scores, err := evalCtx.BatchDotProduct(context.Background(), encryptedQuery, store)
+	assert.NoError(t, err)
+	indicators, err := evalCtx.BatchStepThreshold(context.Background(), scores, cutoff)
+	assert.NoError(t, err, "Step threshold failed")
+
+	matches, err := decCtx.CosineSimMatrixDecrypt(context.Background(), indicators)
+	assert.NoError(t, err)
+	for j := range store {
+		sim := utils.DotProduct(query, store[j])
+		if math.Abs(sim-cutoff) < 0.2 {
+			continue // inside the transition band of the approximation
+		}
+		expected := 0.0
+		if sim >= cutoff {
+			expected = 1.0
+		}
+		assert.InDelta(t, expected, matches[0][j], 0.02,
+			"Store %d with similarity %.3f should read %.0f", j, sim, expected)
+	}
+
+	// The default chain is too shallow for the polynomial.
+	encCtx, _, evalCtx, _ = GenerateContexts(InsecureProfile(8, 2))
+	encryptedQuery, err = encCtx.BatchEncrypt(context.Background(), [][]float64{query})
+	assert.NoError(t, err)
+	scores, err = evalCtx.BatchDotProduct(context.Background(), encryptedQuery, store)
+	assert.NoError(t, err)
+	_, err = evalCtx.BatchStepThreshold(context.Background(), scores, cutoff)
+	assert.Error(t, err, "Shallow parameters should be rejected")
+}
+
+func TestParameterProfiles(t *testing.T) {
+	for _, profile := range []Profile{ProfileFast128, ProfileFast192, ProfileDeep128, ProfileDeep192} {
+		params, err := profile.Parameters()
+		assert.NoError(t, err, "Preset %s should validate", profile.Name)
+		assert.Equal(t, profile.Literal.LogN, params.LogN())
+	}
+	assert.Equal(t, 1, ProfileFast128.Depth())
+	assert.Equal(t, StepThresholdLevels, ProfileDeep128.Depth())
+
+	// A larger ring keeps the chain and stays secure.
+	bigger := ProfileFast128.WithLogN(13)
+	params, err := bigger.Parameters()
+	assert.NoError(t, err)
+	assert.Equal(t, 8192, params.MaxSlots())
+	assert.Equal(t, 12, ProfileFast128.Literal.LogN, "WithLogN should not modify the preset")
+
+	// The historical LogN=10 chain is far beyond what 128-bit security allows.
+	legacy := InsecureProfile(10, 2)
+	_, err = legacy.Parameters()
+	assert.NoError(t, err, "Insecure profiles skip the security check")
+	legacy.Security = Security128
+	_, err = legacy.Parameters()
+	assert.Error(t, err, "LogN=10 with log2(QP)=155 is not 128-bit secure")
+
+	// Deep chains need a bigger ring for the stronger level.
+	_, err = ProfileDeep128.WithLogN(14).Parameters()
+	assert.NoError(t, err)
+	deep := ProfileDeep128
+	deep.Security = Security192
+	_, err = deep.Parameters()
+	assert.Error(t, err, "deep-128 chain at LogN=14 is not 192-bit secure")
+
+	custom, err := NewProfile("custom", ckks.ParametersLiteral{
+		LogN:            13,
+		LogQ:            []int{50, 40, 40},
+		LogP:            []int{50},
+		LogDefaultScale: 40,
+	}, Security128)
+	assert.NoError(t, err, "Custom literal within the bounds should be accepted")
+	assert.Equal(t, 2, custom.Depth())
+
+	_, err = NewProfile("broken", ckks.ParametersLiteral{LogN: 13}, Security128)
+	assert.Error(t, err, "Literal without a modulus chain should be rejected")
+
+	_, _, _, err = GenerateContexts(legacy)
+	assert.Error(t, err, "GenerateContexts should return the validation error instead of panicking")
+}
+
+func TestContextsSizedForVocabulary(t *testing.T) {
+	base := InsecureProfile(8, 1)
+
+	sized, err := base.ForDimension(200)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, sized.Literal.LogN, "256 slots already fit 200 features")
+
+	sized, err = base.ForDimension(600)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, sized.Literal.LogN, "Smallest ring with at least 600 slots")
+
+	_, err = base.ForDimension(1<<maxLogN + 1)
+	assert.Error(t, err, "Vectors beyond the largest ring should be rejected")
+
+	vectorizer := data.NewTfidfVectorizer(2, 1)
+	vectorizer.Fit([]string{"alpha beta", "gamma delta", "epsilon zeta eta theta", "iota kappa lambda mu"})
+	dim := vectorizer.Vocabulary.Size()
+
+	enc, dec, eval, err := GenerateContextsForVectorizer(InsecureProfile(4, 1), vectorizer, nil)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, dec.Params().MaxSlots(), dim)
+	assert.Less(t, dec.Params().MaxSlots()/2, dim, "Ring should be the smallest that fits")
+
+	// The compressed length decides when a filter is configured.
+	cfg := &compression.Config{Kind: compression.LowPass, Low: 12}
+	_, dec2, _, err := GenerateContextsForVectorizer(InsecureProfile(4, 1), vectorizer, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 32, dec2.Params().MaxSlots())
+	compressed, err := cfg.Compress(vectorizer.Transform("alpha"))
+	assert.NoError(t, err)
+	assert.Equal(t, 24, len(compressed))
+	_, _, _, err = GenerateContextsForVectorizer(InsecureProfile(4, 1), vectorizer, &compression.Config{Kind: compression.LowPass, Low: dim + 1})
+	assert.Error(t, err, "A cutoff beyond the vector length should be rejected")
+
+	_, _, _, err = GenerateContextsForVectorizer(base, data.NewTfidfVectorizer(2, 1), nil)
+	assert.Error(t, err, "An unfitted vectorizer has no dimension to size for")
+
+	// Store vectors longer than the slot count are rejected up front.
+	query, err := enc.BatchEncrypt(context.Background(), [][]float64{vectorizer.Transform("alpha")})
+	assert.NoError(t, err)
+	tooLong := make([]float64, dec.Params().MaxSlots()+1)
+	_, err = eval.BatchDotProduct(context.Background(), query, [][]float64{tooLong})
+	assert.Error(t, err)
+}
+
+func TestBatchErrorsReportFailedCells(t *testing.T) {
+	encCtx, decCtx, evalCtx, _ := GenerateContexts(InsecureProfile(8, 2))
+
+	query := utils.GenerateTestVector(32)
+	utils.NormalizeVector(&query)
+	tooLong := utils.GenerateTestVector(300)
+
+	encrypted, err := encCtx.BatchEncrypt(context.Background(), [][]float64{query, tooLong})
+	var batchErr *BatchError
+	assert.True(t, errors.As(err, &batchErr), "Expected a *BatchError, got %v", err)
+	assert.True(t, errors.Is(err, ErrVectorTooLong))
+	assert.True(t, batchErr.Failed(1, -1))
+	assert.False(t, batchErr.Failed(0, -1))
+	assert.NotNil(t, encrypted[0], "Valid vectors are still encrypted")
+	assert.Nil(t, encrypted[1])
+
+	store := [][]float64{query, query}
+	resultMatrix, err := evalCtx.BatchDotProduct(context.Background(), encrypted[:1], store)
+	assert.NoError(t, err)
+
+	// A missing cell is reported and reads NaN instead of panicking.
+	resultMatrix[0][1] = nil
+	sims, err := decCtx.CosineSimMatrixDecrypt(context.Background(), resultMatrix)
+	assert.True(t, errors.As(err, &batchErr), "Expected a *BatchError, got %v", err)
+	assert.Equal(t, 1, len(batchErr.Errors))
+	assert.Equal(t, 0, batchErr.Errors[0].Row)
+	assert.Equal(t, 1, batchErr.Errors[0].Col)
+	assert.True(t, errors.Is(err, ErrNilCiphertext))
+	assert.InDelta(t, 1.0, sims[0][0], 1e-4)
+	assert.True(t, math.IsNaN(sims[0][1]), "Failed cell should be NaN")
+
+	sims, err = decCtx.CosineSimMatrixDecrypt(context.Background(), [][]*rlwe.Ciphertext{})
+	assert.NoError(t, err)
+	assert.Empty(t, sims, "Empty matrix should not panic")
+
+	_, err = evalCtx.BatchDotProduct(context.Background(), encrypted[:1], [][]float64{tooLong})
+	assert.True(t, errors.Is(err, ErrVectorTooLong))
+
+	// Without Galois keys the inner sum cannot rotate, which is an error
+	// rather than a wrong score.
+	kgen := ckks.NewKeyGenerator(*evalCtx.params)
+	noRotations := NewEvaluatorContext(*evalCtx.params, kgen.GenRelinearizationKeyNew(kgen.GenSecretKeyNew()), nil)
+	_, err = noRotations.BatchDotProduct(context.Background(), encrypted[:1], store)
+	assert.Error(t, err, "A failed rotation should be reported")
+}
+
+func TestBoundedWorkersAndCancellation(t *testing.T) {
+	// forEach never runs more than the requested number of items at once.
+	var running, peak atomic.Int32
+	err := forEach(context.Background(), 3, 50, func() func(int) {
+		return func(int) {
+			n := running.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			running.Add(-1)
+		}
+	})
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, peak.Load(), int32(3), "At most 3 items should run concurrently")
+
+	encCtx, decCtx, evalCtx, _ := GenerateContexts(InsecureProfile(8, 2))
+	encCtx.Workers, decCtx.Workers, evalCtx.Workers = 2, 2, 2
+
+	queries := make([][]float64, 3)
+	for i := range queries {
+		queries[i] = utils.GenerateTestVector(32)
+		utils.NormalizeVector(&queries[i])
+	}
+	store := make([][]float64, 4)
+	for i := range store {
+		store[i] = utils.GenerateTestVector(32)
+		utils.NormalizeVector(&store[i])
+	}
+	encrypted, err := encCtx.BatchEncrypt(context.Background(), queries)
+	assert.NoError(t, err)
+
+	// Every cell arrives exactly once on the stream.
+	stream, err := evalCtx.StreamDotProduct(context.Background(), encrypted, store)
+	assert.NoError(t, err)
+	seen := make(map[[2]int]bool)
+	for cell := range stream {
+		assert.NoError(t, cell.Err)
+		assert.False(t, seen[[2]int{cell.Row, cell.Col}], "Cell (%d,%d) streamed twice", cell.Row, cell.Col)
+		seen[[2]int{cell.Row, cell.Col}] = true
+		decrypted, err := decCtx.BatchDecrypt(context.Background(), []*rlwe.Ciphertext{cell.Ciphertext})
+		assert.NoError(t, err)
+		assert.InDelta(t, utils.DotProduct(queries[cell.Row], store[cell.Col]), decrypted[0][0], 1e-4)
+	}
+	assert.Equal(t, len(queries)*len(store), len(seen))
+
+	// A cancelled context stops the batch and is reported as such.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = evalCtx.BatchDotProduct(ctx, encrypted, store)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = encCtx.BatchEncrypt(ctx, queries)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Abandoning a stream part way through must not leak its workers.
+	ctx, cancel = context.WithCancel(context.Background())
+	stream, err = evalCtx.StreamDotProduct(ctx, encrypted, store)
+	assert.NoError(t, err)
+	<-stream
+	cancel()
+	for range stream {
+	}
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+}
+
+func TestContextsFromSerializedKeys(t *testing.T) {
+	encCtx, decCtx, _, err := GenerateContexts(InsecureProfile(8, 2))
+	assert.NoError(t, err)
+	params := decCtx.Params()
+	rlk, gks := encCtx.EvaluationKeys()
+
+	paramsData, err := serialization.MarshalParameters(params)
+	assert.NoError(t, err)
+	pkData, err := serialization.MarshalPublicKey(params, decCtx.PublicKey())
+	assert.NoError(t, err)
+	skData, err := serialization.MarshalSecretKey(params, decCtx.SecretKey())
+	assert.NoError(t, err)
+	rlkData, err := serialization.MarshalRelinearizationKey(params, rlk)
+	assert.NoError(t, err)
+	gksData, err := serialization.MarshalGaloisKeys(params, gks)
+	assert.NoError(t, err)
+
+	// Each party rebuilds its own side from bytes and only sees the interface.
+	var enc Encryptor
+	var eval Evaluator
+	var dec Decryptor
+	enc, err = NewEncryptorFromBytes(paramsData, pkData)
+	assert.NoError(t, err)
+	eval, err = NewEvaluatorFromBytes(paramsData, rlkData, gksData)
+	assert.NoError(t, err)
+	dec, err = NewDecryptorFromBytes(paramsData, skData)
+	assert.NoError(t, err)
+
+	query := utils.GenerateTestVector(40)
+	store := utils.GenerateTestVector(40)
+	utils.NormalizeVector(&query)
+	utils.NormalizeVector(&store)
+
+	encrypted, err := enc.BatchEncrypt(context.Background(), [][]float64{query})
+	assert.NoError(t, err)
+	scores, err := eval.BatchDotProduct(context.Background(), encrypted, [][]float64{store})
+	assert.NoError(t, err)
+	sims, err := dec.CosineSimMatrixDecrypt(context.Background(), scores)
+	assert.NoError(t, err)
+	assert.InDelta(t, utils.DotProduct(query, store), sims[0][0], 1e-4)
+
+	_, err = NewEvaluatorFromBytes(paramsData, pkData, gksData)
+	assert.ErrorIs(t, err, serialization.ErrUnexpectedKind, "A public key is not a relinearization key")
+}
+
+func TestContextsForHashingVectorizer(t *testing.T) {
+	vectorizer, err := data.NewHashingVectorizer(2, 512, []byte("seed"))
+	assert.NoError(t, err)
+
+	encCtx, decCtx, evalCtx, err := GenerateContextsForVectorizer(InsecureProfile(8, 1), vectorizer, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 512, decCtx.Params().MaxSlots(), "The ring should match the hashed dimension")
+
+	query := vectorizer.Transform("acme widgets")
+	store := vectorizer.BatchTransform([]string{"acme widget", "globex"})
+	utils.NormalizeVector(&query)
+	for i := range store {
+		utils.NormalizeVector(&store[i])
+	}
+	encrypted, err := encCtx.BatchEncrypt(context.Background(), [][]float64{query})
+	assert.NoError(t, err)
+	scores, err := evalCtx.BatchDotProduct(context.Background(), encrypted, store)
+	assert.NoError(t, err)
+	sims, err := decCtx.CosineSimMatrixDecrypt(context.Background(), scores)
+	assert.NoError(t, err)
+	for j := range store {
+		assert.InDelta(t, utils.DotProduct(query, store[j]), sims[0][j], 1e-4)
+	}
+}
+
+func TestWeightedEntityScores(t *testing.T) {
+	store := []data.Entity{
+		{Name: "Acme Holdings Ltd", Address: "1 Main Street, Springfield", Country: "United States", RegistryID: "US-1234567"},
+		{Name: "Zwinkels B.V.", Address: "Dorpsstraat 12, Naaldwijk", Country: "Netherlands", RegistryID: "NL 27.12.34.56"},
+	}
+	query := data.Entity{Name: "acme holdings", Address: "1 Main St, Springfield", Country: "United States"}
+	vectorizer := data.DefaultEntityVectorizer()
+	vectorizer.Fit(store)
+
+	encCtx, decCtx, evalCtx, err := GenerateContexts(InsecureProfile(10, 2))
+	assert.NoError(t, err)
+	evalCtx.Weights = vectorizer.Weights()
+
+	ctx := context.Background()
+	cts, err := encCtx.BatchEncrypt(ctx, [][]float64{vectorizer.Transform(query)})
+	assert.NoError(t, err)
+	storeVectors := vectorizer.BatchTransform(store)
+	resultMatrix, err := evalCtx.BatchDotProduct(ctx, cts, storeVectors)
+	assert.NoError(t, err)
+	scores, err := decCtx.CosineSimMatrixDecrypt(ctx, resultMatrix)
+	assert.NoError(t, err)
+	packed, err := evalCtx.BatchDotProductPacked(ctx, cts, storeVectors)
+	assert.NoError(t, err)
+	packedScores, err := decCtx.CosineSimMatrixDecryptPacked(ctx, packed)
+	assert.NoError(t, err)
+
+	for j, e := range store {
+		_, want := vectorizer.FieldSimilarities(query, e)
+		assert.InDelta(t, want, scores[0][j], 1e-4, "Entity %d", j)
+		assert.InDelta(t, want, packedScores[0][j], 1e-4, "Packed entity %d", j)
+	}
+	assert.Greater(t, scores[0][0], scores[0][1])
+	// The store vectors themselves are not scaled.
+	assert.Equal(t, vectorizer.Transform(store[0]), storeVectors[0])
+}
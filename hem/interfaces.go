@@ -0,0 +1,36 @@
+package hem
+
+import (
+	"context"
+
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+)
+
+// Encryptor is the querier's side: it encrypts vectors under the key owner's
+// public key.
+type Encryptor interface {
+	BatchEncrypt(ctx context.Context, vectors [][]float64) ([]*rlwe.Ciphertext, error)
+}
+
+// Evaluator is the data holder's side: it scores encrypted queries against
+// plaintext store vectors without being able to decrypt them.
+type Evaluator interface {
+	BatchDotProduct(ctx context.Context, ct_matrix []*rlwe.Ciphertext, pt_matrix [][]float64) ([][]*rlwe.Ciphertext, error)
+	StreamDotProduct(ctx context.Context, ct_matrix []*rlwe.Ciphertext, pt_matrix [][]float64) (<-chan DotProductResult, error)
+	BatchDotProductPacked(ctx context.Context, ct_matrix []*rlwe.Ciphertext, pt_matrix [][]float64) (*PackedScores, error)
+	BatchStepThreshold(ctx context.Context, ct_matrix [][]*rlwe.Ciphertext, cutoff float64) ([][]*rlwe.Ciphertext, error)
+}
+
+// Decryptor is the key owner's side: it opens the score matrices an Evaluator
+// returns.
+type Decryptor interface {
+	BatchDecrypt(ctx context.Context, ciphertexts []*rlwe.Ciphertext) ([][]float64, error)
+	CosineSimMatrixDecrypt(ctx context.Context, cosineSimMatrix [][]*rlwe.Ciphertext) ([][]float64, error)
+	CosineSimMatrixDecryptPacked(ctx context.Context, packed *PackedScores) ([][]float64, error)
+}
+
+var (
+	_ Encryptor = (*EncryptorContext)(nil)
+	_ Evaluator = (*EvaluatorContext)(nil)
+	_ Decryptor = (*DecryptorContext)(nil)
+)
@@ -1,15 +1,23 @@
 package hem
 
 import (
+	"context"
 	"fmt"
-	"sync"
+	"math"
 
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/compression"
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/data"
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/serialization"
 	"github.com/tuneinsight/lattigo/v6/core/rlwe"
-	"github.com/tuneinsight/lattigo/v6/ring"
 	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
 )
 
-type encryptorContext struct {
+// EncryptorContext encrypts query vectors. It holds only public material: the
+// public key, and the evaluation keys so they can be handed on to whoever
+// runs the EvaluatorContext.
+type EncryptorContext struct {
+	// Workers bounds the goroutines of batch operations; 0 means GOMAXPROCS.
+	Workers int
 	pk *rlwe.PublicKey
 	rlk *rlwe.RelinearizationKey
 	gks []*rlwe.GaloisKey
@@ -18,8 +26,13 @@ type encryptorContext struct {
 	encryptor *rlwe.Encryptor
 }
 
-type decryptorContext struct {
+// DecryptorContext holds the secret key and opens score matrices. Only the
+// key owner should ever have one.
+type DecryptorContext struct {
+	// Workers bounds the goroutines of batch operations; 0 means GOMAXPROCS.
+	Workers int
 	sk *rlwe.SecretKey
+	pk *rlwe.PublicKey
 	params *ckks.Parameters
 	encoder *ckks.Encoder
 	decryptor *rlwe.Decryptor
@@ -27,139 +40,277 @@ type decryptorContext struct {
 
 
 
-func getHEParameters(ln int) ckks.Parameters {
-	params, err := ckks.NewParametersFromLiteral(ckks.ParametersLiteral{
-		LogN:            ln, // With the Bigram Model we will be under 1024 slots
-		LogQ:            []int{45, 35, 35}, 
-		LogP:            []int{40},
-		LogDefaultScale: 35,
-		RingType:        ring.ConjugateInvariant, // real numbers.
-	})
+// galoisElements lists the rotations the evaluator needs: a full InnerSum for
+// DotProduct, plus the partial InnerSum and Replicate of every power-of-two
+// block size for the packed mode.
+func galoisElements(params ckks.Parameters) []uint64 {
+	seen := make(map[uint64]bool)
+	var galEls []uint64
+	add := func(els []uint64) {
+		for _, el := range els {
+			if !seen[el] {
+				seen[el] = true
+				galEls = append(galEls, el)
+			}
+		}
+	}
+	add(params.GaloisElementsForInnerSum(1, params.MaxSlots()))
+	for blockSize := 1; blockSize < params.MaxSlots(); blockSize <<= 1 {
+		add(params.GaloisElementsForInnerSum(1, blockSize))
+		add(params.GaloisElementsForReplicate(blockSize, params.MaxSlots()/blockSize))
+	}
+	return galEls
+}
+
+// GenerateContexts instantiates the profile's parameters and generates a fresh
+// key set. It fails if the profile does not reach its security level.
+func GenerateContexts(profile Profile) (*EncryptorContext, *DecryptorContext, *EvaluatorContext, error) {
+	params, err := profile.Parameters()
 	if err != nil {
-		panic(err)
+		return nil, nil, nil, err
 	}
-	return params
+	enc, dec, eval := generateContexts(params)
+	return enc, dec, eval, nil
 }
 
-// ln is the log of the number of slots 8 = 256, 9 = 512, 10 = 1024.
-// Set this value based on expected
-func GenerateContexts(ln int) (*encryptorContext, *decryptorContext, *evaluatorContext) {
-	params := getHEParameters(ln)
+// GenerateContextsForDimension generates contexts on the smallest ring of the
+// profile that fits vectors of length dim.
+func GenerateContextsForDimension(profile Profile, dim int) (*EncryptorContext, *DecryptorContext, *EvaluatorContext, error) {
+	sized, err := profile.ForDimension(dim)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return GenerateContexts(sized)
+}
+
+// GenerateContextsForVectorizer sizes the ring for the vectors a fitted
+// vectorizer produces, after compression when cfg is not nil.
+func GenerateContextsForVectorizer(profile Profile, vectorizer data.Vectorizer, cfg *compression.Config) (*EncryptorContext, *DecryptorContext, *EvaluatorContext, error) {
+	dim := vectorizer.Size()
+	if dim == 0 {
+		return nil, nil, nil, fmt.Errorf("vectorizer has an empty vocabulary, call Fit first")
+	}
+	if cfg != nil {
+		var err error
+		if dim, err = cfg.OutputSize(dim); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return GenerateContextsForDimension(profile, dim)
+}
+
+func generateContexts(params ckks.Parameters) (*EncryptorContext, *DecryptorContext, *EvaluatorContext) {
 	kgen := ckks.NewKeyGenerator(params)
-	sk,pk := kgen.GenKeyPairNew()
+	sk, pk := kgen.GenKeyPairNew()
 	rlk := kgen.GenRelinearizationKeyNew(sk)
-	gks := kgen.GenGaloisKeysNew(params.GaloisElementsForInnerSum(1, params.MaxSlots()), sk)
-	evk := rlwe.NewMemEvaluationKeySet(rlk, kgen.GenGaloisKeysNew(params.GaloisElementsForInnerSum(1, params.MaxSlots()), sk)...)
-	
-	evaluator := ckks.NewEvaluator(params,evk)
-	encoder := ckks.NewEncoder(params)
-	encryptor := rlwe.NewEncryptor(params, sk)
-	decryptor := rlwe.NewDecryptor(params, sk)
+	gks := kgen.GenGaloisKeysNew(galoisElements(params), sk)
+
+	// The encryptor only ever sees the public key, so the same context can be
+	// handed to a querier that must not be able to decrypt.
+	encryptorCtx := NewEncryptorContext(params, pk)
+	encryptorCtx.rlk = rlk
+	encryptorCtx.gks = gks
 
+	decryptorCtx := NewDecryptorContext(params, sk)
+	decryptorCtx.pk = pk
 
-	encryptorCtx := &encryptorContext{
+	return encryptorCtx, decryptorCtx, NewEvaluatorContext(params, rlk, gks)
+}
+
+// NewEncryptorContext builds an encryptor from public material only. It is
+// what the querying party constructs from the key owner's exported public key.
+func NewEncryptorContext(params ckks.Parameters, pk *rlwe.PublicKey) *EncryptorContext {
+	return &EncryptorContext{
 		params:    &params,
 		pk:        pk,
-		rlk:       rlk,
-		gks:       gks,
-		encoder:   encoder,
-		encryptor: encryptor,
+		encoder:   ckks.NewEncoder(params),
+		encryptor: rlwe.NewEncryptor(params, pk),
+	}
+}
+
+// NewEncryptorFromBytes builds an encryptor from the serialized parameters
+// and public key the key owner published.
+func NewEncryptorFromBytes(paramsData, pkData []byte) (*EncryptorContext, error) {
+	params, err := serialization.UnmarshalParameters(paramsData)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := serialization.UnmarshalPublicKey(params, pkData)
+	if err != nil {
+		return nil, err
 	}
+	return NewEncryptorContext(params, pk), nil
+}
+
+// EvaluationKeys returns the relinearization and Galois keys an
+// EvaluatorContext needs. They are nil for an encryptor built from a public
+// key alone.
+func (ec *EncryptorContext) EvaluationKeys() (*rlwe.RelinearizationKey, []*rlwe.GaloisKey) {
+	return ec.rlk, ec.gks
+}
+
+// Params returns the parameters the encryptor works under.
+func (ec *EncryptorContext) Params() ckks.Parameters {
+	return *ec.params
+}
 
-	decryptorCtx := &decryptorContext{
+// NewDecryptorContext builds a decryptor from a secret key. PublicKey returns
+// nil on the result, as the public key cannot be recovered from sk.
+func NewDecryptorContext(params ckks.Parameters, sk *rlwe.SecretKey) *DecryptorContext {
+	return &DecryptorContext{
 		params:    &params,
 		sk:        sk,
-		encoder:   encoder,
-		decryptor: decryptor,
+		encoder:   ckks.NewEncoder(params),
+		decryptor: rlwe.NewDecryptor(params, sk),
 	}
+}
 
-	evaluatorCtx := &evaluatorContext{
-		params:    &params,
-		encoder:   encoder,
-		evaluator:  evaluator,
-	}
-	return encryptorCtx, decryptorCtx, evaluatorCtx
-
-}
-
-func (ec *encryptorContext) BatchEncrypt(vectors [][]float64) []*rlwe.Ciphertext {
-    numVectors := len(vectors)
-    results := make([]*rlwe.Ciphertext, numVectors)
-    var wg sync.WaitGroup
-
-    for i := range vectors {
-        wg.Add(1)
-        go func(index int) {
-            defer wg.Done()
-            vector := vectors[index]
-
-            // Create thread-local shallow copies.
-            localEncoder := ec.encoder.ShallowCopy()
-            localEncryptor := ec.encryptor.ShallowCopy()
-
-            plaintext := ckks.NewPlaintext(*ec.params, ec.params.MaxLevel())
-            if err := localEncoder.Encode(vector, plaintext); err != nil {
-                // Depending on your error handling strategy, you might log the error or handle it differently.
-                fmt.Printf("Encode error at index %d: %v\n", index, err)
-                return
-            }
-            var err error
-            results[index], err = localEncryptor.EncryptNew(plaintext)
-            if err != nil {
-                fmt.Printf("Encryption error at index %d: %v\n", index, err)
-            }
-        }(i)
-    }
-    wg.Wait()
-    return results
-}
-
-func (dc *decryptorContext) BatchDecrypt(ciphertexts []*rlwe.Ciphertext) [][]float64 {
-    numCiphertexts := len(ciphertexts)
-    results := make([][]float64, numCiphertexts)
-    var wg sync.WaitGroup
-
-    for i := range ciphertexts {
-        wg.Add(1)
-        go func(index int) {
-            defer wg.Done()
-            // Skip nil ciphertexts
-            if ciphertexts[index] == nil {
-                results[index] = nil
-                return
-            }
-			localEncoder := dc.encoder.ShallowCopy()
-			localDecryptor := dc.decryptor.ShallowCopy()
-            // Decrypt the ciphertext
-            decryptedPlaintext := localDecryptor.DecryptNew(ciphertexts[index])
-            // Determine the vector size - use MaxSlots for safety
-            vectorSize := dc.params.MaxSlots()
-            // Allocate and decode the result vector
-            decoded := make([]float64, vectorSize)
-            err := localEncoder.Decode(decryptedPlaintext, decoded)
-            if err != nil {
-                results[index] = nil
-                return
-            }
-            results[index] = decoded
-        }(i)
-    }
-    wg.Wait()
-    return results
-}
-
-func (dc *decryptorContext) CosineSimMatrixDecrypt(cosineSimMatrix [][]*rlwe.Ciphertext) [][]float64 {
-	// allocate space for the results
-	numRows := len(cosineSimMatrix)
-	numCols := len(cosineSimMatrix[0])
-	results := make([][]float64, numRows)
-	for i := range results {
-		results[i] = make([]float64, numCols)
-		decryptedBatch := dc.BatchDecrypt(cosineSimMatrix[i])
+// NewDecryptorFromBytes builds a decryptor from serialized parameters and a
+// secret key written with serialization.MarshalSecretKey.
+func NewDecryptorFromBytes(paramsData, skData []byte) (*DecryptorContext, error) {
+	params, err := serialization.UnmarshalParameters(paramsData)
+	if err != nil {
+		return nil, err
+	}
+	sk, err := serialization.UnmarshalSecretKey(params, skData)
+	if err != nil {
+		return nil, err
+	}
+	return NewDecryptorContext(params, sk), nil
+}
+
+// SecretKey returns the key owner's secret key, for persisting with
+// serialization.MarshalSecretKey.
+func (dc *DecryptorContext) SecretKey() *rlwe.SecretKey {
+	return dc.sk
+}
+
+// PublicKey returns the public key the key owner exports to the querier.
+func (dc *DecryptorContext) PublicKey() *rlwe.PublicKey {
+	return dc.pk
+}
+
+// Params returns the parameters the public key was generated under.
+func (dc *DecryptorContext) Params() ckks.Parameters {
+	return *dc.params
+}
+
+// BatchEncrypt encrypts every vector under the public key on at most Workers
+// goroutines. A vector that cannot be encrypted leaves a nil entry and is
+// reported in the returned *BatchError; the other ciphertexts are still
+// usable. If ctx is cancelled the remaining vectors are skipped and ctx.Err()
+// is returned.
+func (ec *EncryptorContext) BatchEncrypt(ctx context.Context, vectors [][]float64) ([]*rlwe.Ciphertext, error) {
+	results := make([]*rlwe.Ciphertext, len(vectors))
+	var errs batchErrors
+
+	err := forEach(ctx, ec.Workers, len(vectors), func() func(int) {
+		// Worker-local shallow copies.
+		localEncoder := ec.encoder.ShallowCopy()
+		localEncryptor := ec.encryptor.ShallowCopy()
+		return func(index int) {
+			vector := vectors[index]
+			if len(vector) > ec.params.MaxSlots() {
+				errs.add("encrypt", index, -1, fmt.Errorf("%w: %d values, %d slots", ErrVectorTooLong, len(vector), ec.params.MaxSlots()))
+				return
+			}
+			plaintext := ckks.NewPlaintext(*ec.params, ec.params.MaxLevel())
+			if err := localEncoder.Encode(vector, plaintext); err != nil {
+				errs.add("encode", index, -1, err)
+				return
+			}
+			ct, err := localEncryptor.EncryptNew(plaintext)
+			if err != nil {
+				errs.add("encrypt", index, -1, err)
+				return
+			}
+			results[index] = ct
+		}
+	})
+	if err != nil {
+		return results, err
+	}
+	return results, errs.err()
+}
+
+// BatchDecrypt decrypts and decodes every ciphertext to MaxSlots values on at
+// most Workers goroutines. Nil ciphertexts and decoding failures leave a nil
+// row and are reported in the returned *BatchError. If ctx is cancelled the
+// remaining ciphertexts are skipped and ctx.Err() is returned.
+func (dc *DecryptorContext) BatchDecrypt(ctx context.Context, ciphertexts []*rlwe.Ciphertext) ([][]float64, error) {
+	results := make([][]float64, len(ciphertexts))
+	var errs batchErrors
+
+	err := forEach(ctx, dc.Workers, len(ciphertexts), func() func(int) {
+		localEncoder := dc.encoder.ShallowCopy()
+		localDecryptor := dc.decryptor.ShallowCopy()
+		return func(index int) {
+			if ciphertexts[index] == nil {
+				errs.add("decrypt", index, -1, ErrNilCiphertext)
+				return
+			}
+			decryptedPlaintext := localDecryptor.DecryptNew(ciphertexts[index])
+			decoded := make([]float64, dc.params.MaxSlots())
+			if err := localEncoder.Decode(decryptedPlaintext, decoded); err != nil {
+				errs.add("decode", index, -1, err)
+				return
+			}
+			results[index] = decoded
+		}
+	})
+	if err != nil {
+		return results, err
+	}
+	return results, errs.err()
+}
+
+// CosineSimMatrixDecryptPacked unpacks the result of BatchDotProductPacked
+// into the same query x store matrix CosineSimMatrixDecrypt returns, with the
+// same handling of failed cells.
+func (dc *DecryptorContext) CosineSimMatrixDecryptPacked(ctx context.Context, packed *PackedScores) ([][]float64, error) {
+	perCt := packed.ScoresPerCiphertext(dc.params.MaxSlots())
+	results := make([][]float64, len(packed.Ciphertexts))
+	var errs batchErrors
+	for i, row := range packed.Ciphertexts {
+		results[i] = make([]float64, packed.NumScores)
+		decryptedBatch, err := dc.BatchDecrypt(ctx, row)
+		if _, ok := err.(*BatchError); err != nil && !ok {
+			return results, err // cancelled
+		}
+		for j := range results[i] {
+			if decryptedBatch[j/perCt] == nil {
+				// Every score packed into a failed ciphertext is lost.
+				results[i][j] = math.NaN()
+				errs.add("decrypt", i, j, err.(*BatchError).cause(j/perCt, -1))
+				continue
+			}
+			results[i][j] = decryptedBatch[j/perCt][(j%perCt)*packed.BlockSize]
+		}
+	}
+	return results, errs.err()
+}
+
+// CosineSimMatrixDecrypt decrypts a BatchDotProduct result into a query x
+// store matrix of scores. A cell that cannot be decrypted is set to NaN and
+// reported in the returned *BatchError, so it is never mistaken for a score.
+// Cancelling ctx stops after the current row and returns ctx.Err().
+func (dc *DecryptorContext) CosineSimMatrixDecrypt(ctx context.Context, cosineSimMatrix [][]*rlwe.Ciphertext) ([][]float64, error) {
+	results := make([][]float64, len(cosineSimMatrix))
+	var errs batchErrors
+	for i := range cosineSimMatrix {
+		results[i] = make([]float64, len(cosineSimMatrix[i]))
+		decryptedBatch, err := dc.BatchDecrypt(ctx, cosineSimMatrix[i])
+		if _, ok := err.(*BatchError); err != nil && !ok {
+			return results, err // cancelled
+		}
 		for j := range results[i] {
+			if decryptedBatch[j] == nil {
+				results[i][j] = math.NaN()
+				errs.add("decrypt", i, j, err.(*BatchError).cause(j, -1))
+				continue
+			}
 			results[i][j] = decryptedBatch[j][0]
 		}
 	}
-	return results
-	
-}
\ No newline at end of file
+	return results, errs.err()
+}
@@ -0,0 +1,172 @@
+package hem
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/tuneinsight/lattigo/v6/ring"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+)
+
+// SecurityLevel is the classical bit security a Profile is checked against.
+type SecurityLevel int
+
+const (
+	// SecurityNone skips the security check. Only for tests and benchmarks,
+	// where small rings keep key generation fast.
+	SecurityNone SecurityLevel = 0
+	Security128  SecurityLevel = 128
+	Security192  SecurityLevel = 192
+	Security256  SecurityLevel = 256
+)
+
+// maxLogQP is the largest log2(QP) the Homomorphic Encryption Standard (2018)
+// allows for a ternary secret at a given security level and LogN.
+var maxLogQP = map[SecurityLevel]map[int]int{
+	Security128: {10: 27, 11: 54, 12: 109, 13: 218, 14: 438, 15: 881},
+	Security192: {10: 19, 11: 37, 12: 75, 13: 152, 14: 305, 15: 611},
+	Security256: {10: 14, 11: 29, 12: 58, 13: 118, 14: 237, 15: 476},
+}
+
+// Profile is a named CKKS parameter set together with the security level it
+// must reach.
+type Profile struct {
+	Name     string
+	Literal  ckks.ParametersLiteral
+	Security SecurityLevel
+}
+
+// Preset profiles. The Fast ones have a single level above the base prime,
+// which is all DotProduct needs; the Deep ones carry StepThresholdLevels
+// levels for StepThreshold. Each uses the smallest LogN that reaches its
+// security level; WithLogN can raise it to fit longer vectors.
+var (
+	ProfileFast128 = Profile{
+		Name:     "fast-128",
+		Literal:  literal(12, []int{40, 30}, []int{38}, 30),
+		Security: Security128,
+	}
+	ProfileFast192 = Profile{
+		Name:     "fast-192",
+		Literal:  literal(13, []int{45, 35}, []int{40}, 35),
+		Security: Security192,
+	}
+	ProfileDeep128 = Profile{
+		Name:     "deep-128",
+		Literal:  literal(14, chain(45, 35, StepThresholdLevels), []int{40}, 35),
+		Security: Security128,
+	}
+	ProfileDeep192 = Profile{
+		Name:     "deep-192",
+		Literal:  literal(15, chain(45, 35, StepThresholdLevels), []int{40}, 35),
+		Security: Security192,
+	}
+)
+
+// InsecureProfile is the historical parameter set, a 45-bit base prime and
+// levels 35-bit primes, at any LogN and without a security check.
+func InsecureProfile(logN, levels int) Profile {
+	return Profile{
+		Name:     fmt.Sprintf("insecure-%d-%d", logN, levels),
+		Literal:  literal(logN, chain(45, 35, levels), []int{40}, 35),
+		Security: SecurityNone,
+	}
+}
+
+// NewProfile wraps a custom parameter literal and checks it against security.
+func NewProfile(name string, lit ckks.ParametersLiteral, security SecurityLevel) (Profile, error) {
+	p := Profile{Name: name, Literal: lit, Security: security}
+	if _, err := p.Parameters(); err != nil {
+		return Profile{}, err
+	}
+	return p, nil
+}
+
+func literal(logN int, logQ, logP []int, logScale int) ckks.ParametersLiteral {
+	return ckks.ParametersLiteral{
+		LogN:            logN,
+		LogQ:            logQ,
+		LogP:            logP,
+		LogDefaultScale: logScale,
+		RingType:        ring.ConjugateInvariant, // real numbers.
+	}
+}
+
+func chain(base, prime, levels int) []int {
+	logQ := []int{base}
+	for i := 0; i < levels; i++ {
+		logQ = append(logQ, prime)
+	}
+	return logQ
+}
+
+// WithLogN returns a copy of the profile on a ring of degree 2^logN. The
+// modulus chain is unchanged, so a larger ring never lowers security.
+func (p Profile) WithLogN(logN int) Profile {
+	p.Literal.LogN = logN
+	p.Literal.LogQ = append([]int(nil), p.Literal.LogQ...)
+	p.Literal.LogP = append([]int(nil), p.Literal.LogP...)
+	p.Name = fmt.Sprintf("%s/logn%d", p.Name, logN)
+	return p
+}
+
+// Depth returns how many rescales a fresh ciphertext survives.
+func (p Profile) Depth() int {
+	return len(p.Literal.LogQ) - 1
+}
+
+// Parameters validates the profile and instantiates its ckks parameters.
+func (p Profile) Parameters() (ckks.Parameters, error) {
+	params, err := ckks.NewParametersFromLiteral(p.Literal)
+	if err != nil {
+		return params, fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	if err := checkSecurity(params, p.Security); err != nil {
+		return params, fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	return params, nil
+}
+
+func checkSecurity(params ckks.Parameters, security SecurityLevel) error {
+	if security == SecurityNone {
+		return nil
+	}
+	table, ok := maxLogQP[security]
+	if !ok {
+		return fmt.Errorf("unknown security level %d", security)
+	}
+	bound, ok := table[params.LogN()]
+	if !ok {
+		if params.LogN() < 10 {
+			return fmt.Errorf("LogN=%d is below the HE standard tables", params.LogN())
+		}
+		// Beyond the tables the bound keeps doubling with N.
+		bound = table[15] << (params.LogN() - 15)
+	}
+	if logQP := int(math.Ceil(params.LogQP())); logQP > bound {
+		return fmt.Errorf("log2(QP)=%d exceeds %d allowed at LogN=%d for %d-bit security", logQP, bound, params.LogN(), security)
+	}
+	return nil
+}
+
+// maxLogN is the largest ring the sizing helpers will pick.
+const maxLogN = 16
+
+// ForDimension returns the profile on the smallest ring, no smaller than the
+// profile's own, whose slots hold a vector of length dim. Raising LogN keeps
+// the modulus chain, so the profile's security level still holds.
+func (p Profile) ForDimension(dim int) (Profile, error) {
+	if dim < 1 {
+		return Profile{}, fmt.Errorf("vector length must be positive, got %d", dim)
+	}
+	// The ConjugateInvariant ring has 2^LogN real slots.
+	for logN := p.Literal.LogN; logN <= maxLogN; logN++ {
+		if 1<<logN >= dim {
+			if logN == p.Literal.LogN {
+				return p, nil
+			}
+			return p.WithLogN(logN), nil
+		}
+	}
+	return Profile{}, fmt.Errorf("vector length %d exceeds the %d slots of the largest supported ring", dim, 1<<maxLogN)
+}
@@ -0,0 +1,49 @@
+package hem
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// workerCount resolves a Workers setting: anything below 1 means GOMAXPROCS.
+func workerCount(workers int) int {
+	if workers < 1 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return workers
+}
+
+// forEach runs the items 0..n-1 on at most workers goroutines. newWorker is
+// called once per goroutine, so each one can hold its own shallow copies of
+// encoders and evaluators. It stops handing out items once ctx is done and
+// then returns ctx.Err(); items already started still finish.
+func forEach(ctx context.Context, workers, n int, newWorker func() func(i int)) error {
+	workers = min(workerCount(workers), n)
+	items := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			work := newWorker()
+			for i := range items {
+				work(i)
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case items <- i:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break feed
+		}
+	}
+	close(items)
+	wg.Wait()
+	return err
+}
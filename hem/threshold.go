@@ -0,0 +1,353 @@
+package hem
+
+import (
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/multiparty"
+	"github.com/tuneinsight/lattigo/v6/ring"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"github.com/tuneinsight/lattigo/v6/utils/sampling"
+)
+
+// thresholdPrecisionBits is how precise a threshold decryption stays despite
+// the noise every party adds to its share, see smudgingSigma.
+const thresholdPrecisionBits = 20
+
+// ThresholdParty is one of the N key holders of a T-out-of-N setup. Its own
+// secret key is only used while the collective keys are generated; after that
+// it decrypts with its aggregated Shamir share.
+type ThresholdParty struct {
+	ID        multiparty.ShamirPublicPoint
+	threshold int
+	params    *ckks.Parameters
+	sk        *rlwe.SecretKey
+	tsk       multiparty.ShamirSecretShare
+	combiner  multiparty.Combiner
+}
+
+// ThresholdDecryptorContext opens ciphertexts under the collective key once
+// the decryption shares of Threshold parties have been combined. It holds no
+// secret material itself.
+type ThresholdDecryptorContext struct {
+	Threshold int
+	params    *ckks.Parameters
+	encoder   *ckks.Encoder
+	keySwitch multiparty.KeySwitchProtocol
+	decryptor *rlwe.Decryptor // decrypts under the all-zero key after the key switch
+}
+
+// GenerateThresholdContexts runs the collective key generation of nParties
+// parties with a decryption threshold of threshold, simulating every party in
+// this process. crs seeds the common reference string all parties agree on.
+// The returned encryptor and evaluator only hold public keys; ciphertexts can
+// only be opened by the decryptor once threshold parties took part.
+func GenerateThresholdContexts(profile Profile, nParties, threshold int, crs []byte) (*EncryptorContext, *EvaluatorContext, *ThresholdDecryptorContext, []*ThresholdParty, error) {
+	if nParties < 2 {
+		return nil, nil, nil, nil, fmt.Errorf("need at least 2 parties, got %d", nParties)
+	}
+	if threshold < 1 || threshold > nParties {
+		return nil, nil, nil, nil, fmt.Errorf("threshold %d out of range [1, %d]", threshold, nParties)
+	}
+
+	params, err := profile.Parameters()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	prng, err := sampling.NewKeyedPRNG(crs)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	kgen := ckks.NewKeyGenerator(params)
+	points := make([]multiparty.ShamirPublicPoint, nParties)
+	parties := make([]*ThresholdParty, nParties)
+	for i := range parties {
+		points[i] = multiparty.ShamirPublicPoint(i + 1)
+		parties[i] = &ThresholdParty{
+			ID:     points[i],
+			params: &params,
+			sk:     kgen.GenSecretKeyNew(),
+		}
+	}
+
+	if err := thresholdize(params, parties, points, threshold); err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	pk := genCollectivePublicKey(params, prng, parties)
+	rlk := genCollectiveRelinearizationKey(params, prng, parties)
+	gks, err := genCollectiveGaloisKeys(params, prng, parties, galoisElements(params))
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	encryptorCtx := NewEncryptorContext(params, pk)
+	encryptorCtx.rlk = rlk
+	encryptorCtx.gks = gks
+	evaluatorCtx := NewEvaluatorContext(params, rlk, gks)
+
+	// The decryptor only combines shares, so its own noise is never sampled.
+	keySwitch, err := multiparty.NewKeySwitchProtocol(params, params.Xe())
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	decryptorCtx := &ThresholdDecryptorContext{
+		Threshold: threshold,
+		params:    &params,
+		encoder:   ckks.NewEncoder(params),
+		keySwitch: keySwitch,
+		decryptor: rlwe.NewDecryptor(params, rlwe.NewSecretKey(params)),
+	}
+
+	return encryptorCtx, evaluatorCtx, decryptorCtx, parties, nil
+}
+
+// thresholdize turns the N-out-of-N secret keys into T-out-of-N Shamir shares:
+// every party deals a share of its key to every other party, and each party
+// sums what it received.
+func thresholdize(params ckks.Parameters, parties []*ThresholdParty, points []multiparty.ShamirPublicPoint, threshold int) error {
+	thr := multiparty.NewThresholdizer(params)
+	polys := make([]multiparty.ShamirPolynomial, len(parties))
+	for i, p := range parties {
+		poly, err := thr.GenShamirPolynomial(threshold, p.sk)
+		if err != nil {
+			return err
+		}
+		polys[i] = poly
+	}
+
+	share := thr.AllocateThresholdSecretShare()
+	for _, p := range parties {
+		p.tsk = thr.AllocateThresholdSecretShare()
+		for _, poly := range polys {
+			thr.GenShamirSecretShare(p.ID, poly, &share)
+			if err := thr.AggregateShares(p.tsk, share, &p.tsk); err != nil {
+				return err
+			}
+		}
+		p.threshold = threshold
+		p.combiner = multiparty.NewCombiner(*params.GetRLWEParameters(), p.ID, points, threshold)
+	}
+	return nil
+}
+
+func genCollectivePublicKey(params ckks.Parameters, crs multiparty.CRS, parties []*ThresholdParty) *rlwe.PublicKey {
+	ckg := multiparty.NewPublicKeyGenProtocol(params)
+	crp := ckg.SampleCRP(crs)
+	combined := ckg.AllocateShare()
+	share := ckg.AllocateShare()
+	for _, p := range parties {
+		ckg.GenShare(p.sk, crp, &share)
+		ckg.AggregateShares(share, combined, &combined)
+	}
+	pk := rlwe.NewPublicKey(params)
+	ckg.GenPublicKey(combined, crp, pk)
+	return pk
+}
+
+func genCollectiveRelinearizationKey(params ckks.Parameters, crs multiparty.CRS, parties []*ThresholdParty) *rlwe.RelinearizationKey {
+	rkg := multiparty.NewRelinearizationKeyGenProtocol(params)
+	crp := rkg.SampleCRP(crs)
+	_, combined1, combined2 := rkg.AllocateShare()
+
+	ephSks := make([]*rlwe.SecretKey, len(parties))
+	shares1 := make([]multiparty.RelinearizationKeyGenShare, len(parties))
+	shares2 := make([]multiparty.RelinearizationKeyGenShare, len(parties))
+	for i := range parties {
+		ephSks[i], shares1[i], shares2[i] = rkg.AllocateShare()
+	}
+
+	// Round one needs every party's share before round two can start.
+	for i, p := range parties {
+		rkg.GenShareRoundOne(p.sk, crp, ephSks[i], &shares1[i])
+		rkg.AggregateShares(shares1[i], combined1, &combined1)
+	}
+	for i, p := range parties {
+		rkg.GenShareRoundTwo(ephSks[i], p.sk, combined1, &shares2[i])
+		rkg.AggregateShares(shares2[i], combined2, &combined2)
+	}
+
+	rlk := rlwe.NewRelinearizationKey(params)
+	rkg.GenRelinearizationKey(combined1, combined2, rlk)
+	return rlk
+}
+
+func genCollectiveGaloisKeys(params ckks.Parameters, crs multiparty.CRS, parties []*ThresholdParty, galEls []uint64) ([]*rlwe.GaloisKey, error) {
+	gkg := multiparty.NewGaloisKeyGenProtocol(params)
+	gks := make([]*rlwe.GaloisKey, len(galEls))
+	share := gkg.AllocateShare()
+	for i, galEl := range galEls {
+		crp := gkg.SampleCRP(crs)
+		combined := gkg.AllocateShare()
+		combined.GaloisElement = galEl
+		for _, p := range parties {
+			if err := gkg.GenShare(p.sk, galEl, crp, &share); err != nil {
+				return nil, err
+			}
+			if err := gkg.AggregateShares(share, combined, &combined); err != nil {
+				return nil, err
+			}
+		}
+		gks[i] = rlwe.NewGaloisKey(params)
+		if err := gkg.GenGaloisKey(combined, crp, gks[i]); err != nil {
+			return nil, err
+		}
+	}
+	return gks, nil
+}
+
+// DecryptionShare is one party's partial decryption of a ciphertext. The
+// additive key share behind it depends on the whole active set, so it only
+// combines with the shares of the other members of that same set.
+type DecryptionShare struct {
+	Party  multiparty.ShamirPublicPoint
+	Active []multiparty.ShamirPublicPoint
+	Share  multiparty.KeySwitchShare
+}
+
+// DecryptionShare computes this party's partial decryption of ct. active lists
+// the Threshold distinct parties taking part in this decryption, and must be
+// the same for every share that is later combined.
+func (tp *ThresholdParty) DecryptionShare(ct *rlwe.Ciphertext, active []multiparty.ShamirPublicPoint) (DecryptionShare, error) {
+	if err := checkActiveSet(active, tp.threshold); err != nil {
+		return DecryptionShare{}, err
+	}
+	if !slices.Contains(active, tp.ID) {
+		return DecryptionShare{}, fmt.Errorf("party %d is not in the active set %v", tp.ID, active)
+	}
+
+	additive := rlwe.NewSecretKey(*tp.params)
+	if err := tp.combiner.GenAdditiveShare(active, tp.ID, tp.tsk, additive); err != nil {
+		return DecryptionShare{}, err
+	}
+
+	sigma := smudgingSigma(*tp.params, ct, tp.threshold)
+	keySwitch, err := multiparty.NewKeySwitchProtocol(*tp.params, ring.DiscreteGaussian{Sigma: sigma, Bound: 6 * sigma})
+	if err != nil {
+		return DecryptionShare{}, err
+	}
+
+	// Switching from the additive share to the zero key leaves c0 + c1*s_i + e,
+	// which sums up to a plain decryption once all active shares are added.
+	share := keySwitch.AllocateShare(ct.Level())
+	keySwitch.GenShare(additive, rlwe.NewSecretKey(*tp.params), ct, &share)
+	return DecryptionShare{Party: tp.ID, Active: slices.Clone(active), Share: share}, nil
+}
+
+// smudgingSigma returns the standard deviation of the noise a party adds to
+// its decryption share of ct, which hides its secret share from whoever
+// combines the shares. The noise of threshold shares adds up to a Gaussian of
+// deviation sqrt(N*threshold)*sigma per slot once decoded, so sigma is
+// scale / (2^thresholdPrecisionBits * sqrt(N*threshold)), and every decrypted
+// slot is off by at most 6 * 2^-20 with overwhelming probability. lattigo
+// samples the noise modulo every prime of the level, so it is also capped at
+// a twelfth of the smallest of them. At the 2^70 scale of a DotProduct output
+// the cap applies, about 2^31 on 35-bit primes, which is the 2^30 of lattigo's
+// examples. At the 2^35 scale of a StepThreshold output it
+// is only about 2^8, too little to hide a share from a dishonest combiner.
+func smudgingSigma(params ckks.Parameters, ct *rlwe.Ciphertext, threshold int) float64 {
+	sigma := ct.Scale.Float64() / (math.Exp2(thresholdPrecisionBits) * math.Sqrt(float64(params.N()*threshold)))
+	return min(sigma, float64(slices.Min(params.Q()[:ct.Level()+1]))/12)
+}
+
+// checkActiveSet checks that active holds exactly threshold distinct parties.
+// The additive shares of any other set do not sum up to the collective key.
+func checkActiveSet(active []multiparty.ShamirPublicPoint, threshold int) error {
+	sorted := slices.Clone(active)
+	slices.Sort(sorted)
+	if len(active) != threshold || len(slices.Compact(sorted)) != threshold {
+		return fmt.Errorf("active set %v is not %d distinct parties", active, threshold)
+	}
+	return nil
+}
+
+// Decrypt combines the decryption shares of an active set and decodes ct.
+// It fails rather than returning noise unless there is exactly one share from
+// every member of an active set of Threshold parties, all computed for that
+// same set.
+func (tdc *ThresholdDecryptorContext) Decrypt(ct *rlwe.Ciphertext, shares []DecryptionShare) ([]float64, error) {
+	if len(shares) < tdc.Threshold {
+		return nil, fmt.Errorf("need %d decryption shares, got %d", tdc.Threshold, len(shares))
+	}
+	if err := checkActiveSet(shares[0].Active, tdc.Threshold); err != nil {
+		return nil, err
+	}
+	active := slices.Clone(shares[0].Active)
+	slices.Sort(active)
+	if len(shares) != len(active) {
+		return nil, fmt.Errorf("active set %v needs %d shares, got %d", active, len(active), len(shares))
+	}
+	seen := make(map[multiparty.ShamirPublicPoint]bool, len(shares))
+	for _, share := range shares {
+		other := slices.Clone(share.Active)
+		slices.Sort(other)
+		if !slices.Equal(active, other) {
+			return nil, fmt.Errorf("share of party %d is for active set %v, not %v", share.Party, share.Active, active)
+		}
+		if !slices.Contains(active, share.Party) || seen[share.Party] {
+			return nil, fmt.Errorf("unexpected or repeated share of party %d for active set %v", share.Party, active)
+		}
+		seen[share.Party] = true
+	}
+
+	combined := tdc.keySwitch.AllocateShare(ct.Level())
+	for _, share := range shares {
+		if err := tdc.keySwitch.AggregateShares(share.Share, combined, &combined); err != nil {
+			return nil, err
+		}
+	}
+
+	out := ckks.NewCiphertext(*tdc.params, ct.Degree(), ct.Level())
+	tdc.keySwitch.KeySwitch(ct, combined, out)
+
+	decoded := make([]float64, tdc.params.MaxSlots())
+	if err := tdc.encoder.Decode(tdc.decryptor.DecryptNew(out), decoded); err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
+
+// CosineSimMatrixDecrypt opens a BatchDotProduct result with the help of the
+// given parties. The first Threshold parties form the active set. Cells that
+// cannot be opened are NaN and reported in the returned *BatchError.
+func (tdc *ThresholdDecryptorContext) CosineSimMatrixDecrypt(cosineSimMatrix [][]*rlwe.Ciphertext, parties []*ThresholdParty) ([][]float64, error) {
+	if len(parties) < tdc.Threshold {
+		return nil, fmt.Errorf("need %d parties to decrypt, got %d", tdc.Threshold, len(parties))
+	}
+	active := make([]multiparty.ShamirPublicPoint, tdc.Threshold)
+	for i := range active {
+		active[i] = parties[i].ID
+	}
+
+	results := make([][]float64, len(cosineSimMatrix))
+	shares := make([]DecryptionShare, tdc.Threshold)
+	var errs batchErrors
+	for i := range cosineSimMatrix {
+		results[i] = make([]float64, len(cosineSimMatrix[i]))
+		for j, ct := range cosineSimMatrix[i] {
+			if ct == nil {
+				results[i][j] = math.NaN()
+				errs.add("threshold decrypt", i, j, ErrNilCiphertext)
+				continue
+			}
+			for k := range shares {
+				share, err := parties[k].DecryptionShare(ct, active)
+				if err != nil {
+					return nil, err
+				}
+				shares[k] = share
+			}
+			decoded, err := tdc.Decrypt(ct, shares)
+			if err != nil {
+				results[i][j] = math.NaN()
+				errs.add("threshold decrypt", i, j, err)
+				continue
+			}
+			results[i][j] = decoded[0]
+		}
+	}
+	return results, errs.err()
+}
@@ -0,0 +1,265 @@
+package fpsi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/data"
+)
+
+// ErrMalformedMessage is returned when a message cannot be decoded.
+var ErrMalformedMessage = errors.New("fpsi: malformed message")
+
+// ProtocolVersion is written into every message. Decoding rejects any other
+// version with ErrUnsupportedVersion, since the fields of a message are
+// positional and a peer on another layout would misread them. Bump it
+// whenever a message gains, loses or reorders a field.
+const ProtocolVersion uint16 = 1
+
+// ErrUnsupportedVersion is returned for a message of another ProtocolVersion.
+var ErrUnsupportedVersion = errors.New("fpsi: unsupported protocol version")
+
+// SetupMessage carries the HE parameters and the vectorizer both parties use,
+// so that their vectors line up slot for slot. The vocabulary is either an
+// Alphabet both sides expand with TfidfVectorizer.FitAlphabet, or the explicit
+// Vocabulary of a fitted vectorizer, which reveals every n-gram of the corpus
+// it was fitted on.
+type SetupMessage struct {
+	Params         []byte // serialization.MarshalParameters
+	Analyzer       data.Analyzer
+	NgramLength    int
+	MaxNgramLength int
+	MinDF          int
+	Phonetics      []data.Phonetic
+	Alphabet       string
+	Vocabulary     []string
+
+	// IDF statistics and weighting options, see data.TfidfVectorizer.
+	NumDocs     int
+	DocFreq     []int
+	SmoothIDF   bool
+	SublinearTF bool
+	Normalize   bool
+
+	// ModelHash is data.TfidfVectorizer.Hash of the Receiver's vectorizer.
+	ModelHash []byte
+	// PipelineVersion and PipelineHash identify the data.Pipeline the
+	// Receiver cleans its names with.
+	PipelineVersion string
+	PipelineHash    []byte
+}
+
+// Bits of the SetupMessage weighting options field.
+const (
+	optionSmoothIDF = 1 << iota
+	optionSublinearTF
+	optionNormalize
+)
+
+// KeysMessage carries the evaluation keys the Sender needs to compute scores.
+type KeysMessage struct {
+	RelinearizationKey []byte // serialization.MarshalRelinearizationKey
+	GaloisKeys         []byte // serialization.MarshalGaloisKeys
+}
+
+// QueryMessage carries the encrypted query vectors, one ciphertext each.
+type QueryMessage struct {
+	Queries []byte // serialization.MarshalCiphertextMatrix, a single row
+}
+
+// ScoresMessage carries the encrypted query x store score matrix.
+type ScoresMessage struct {
+	Scores []byte // serialization.MarshalCiphertextMatrix
+}
+
+func (m *SetupMessage) MarshalBinary() ([]byte, error) {
+	var options int
+	if m.SmoothIDF {
+		options |= optionSmoothIDF
+	}
+	if m.SublinearTF {
+		options |= optionSublinearTF
+	}
+	if m.Normalize {
+		options |= optionNormalize
+	}
+	docFreq := make([]byte, 0, 4*len(m.DocFreq))
+	for _, df := range m.DocFreq {
+		docFreq = binary.BigEndian.AppendUint32(docFreq, uint32(df))
+	}
+	phonetics := make([]byte, len(m.Phonetics))
+	for i, p := range m.Phonetics {
+		phonetics[i] = byte(p)
+	}
+	fields := [][]byte{
+		m.Params, uint32Field(m.NgramLength), uint32Field(m.MinDF), []byte(m.Alphabet),
+		uint32Field(options), uint32Field(m.NumDocs), docFreq,
+		uint32Field(int(m.Analyzer)), uint32Field(m.MaxNgramLength), m.ModelHash, phonetics,
+		[]byte(m.PipelineVersion), m.PipelineHash,
+	}
+	for _, term := range m.Vocabulary {
+		fields = append(fields, []byte(term))
+	}
+	return encodeFields(RoundSetup, fields), nil
+}
+
+func (m *SetupMessage) UnmarshalBinary(buf []byte) error {
+	const header = 13
+	fields, err := decodeFields(buf, RoundSetup, header)
+	if err != nil {
+		return err
+	}
+	m.Params = fields[0]
+	if m.NgramLength, err = readUint32Field(fields[1]); err != nil {
+		return err
+	}
+	if m.MinDF, err = readUint32Field(fields[2]); err != nil {
+		return err
+	}
+	m.Alphabet = string(fields[3])
+	options, err := readUint32Field(fields[4])
+	if err != nil {
+		return err
+	}
+	m.SmoothIDF = options&optionSmoothIDF != 0
+	m.SublinearTF = options&optionSublinearTF != 0
+	m.Normalize = options&optionNormalize != 0
+	if m.NumDocs, err = readUint32Field(fields[5]); err != nil {
+		return err
+	}
+	if len(fields[6])%4 != 0 {
+		return fmt.Errorf("%w: document frequencies of %d bytes", ErrMalformedMessage, len(fields[6]))
+	}
+	m.DocFreq = nil
+	for b := fields[6]; len(b) > 0; b = b[4:] {
+		m.DocFreq = append(m.DocFreq, int(binary.BigEndian.Uint32(b)))
+	}
+	analyzer, err := readUint32Field(fields[7])
+	if err != nil {
+		return err
+	}
+	m.Analyzer = data.Analyzer(analyzer)
+	if m.MaxNgramLength, err = readUint32Field(fields[8]); err != nil {
+		return err
+	}
+	m.ModelHash = fields[9]
+	m.Phonetics = nil
+	for _, p := range fields[10] {
+		m.Phonetics = append(m.Phonetics, data.Phonetic(p))
+	}
+	m.PipelineVersion = string(fields[11])
+	m.PipelineHash = fields[12]
+	m.Vocabulary = make([]string, len(fields)-header)
+	for i, term := range fields[header:] {
+		m.Vocabulary[i] = string(term)
+	}
+	return nil
+}
+
+func (m *KeysMessage) MarshalBinary() ([]byte, error) {
+	return encodeFields(RoundKeys, [][]byte{m.RelinearizationKey, m.GaloisKeys}), nil
+}
+
+func (m *KeysMessage) UnmarshalBinary(data []byte) error {
+	fields, err := decodeFields(data, RoundKeys, 2)
+	if err != nil {
+		return err
+	}
+	m.RelinearizationKey, m.GaloisKeys = fields[0], fields[1]
+	return nil
+}
+
+func (m *QueryMessage) MarshalBinary() ([]byte, error) {
+	return encodeFields(RoundQuery, [][]byte{m.Queries}), nil
+}
+
+func (m *QueryMessage) UnmarshalBinary(data []byte) error {
+	fields, err := decodeFields(data, RoundQuery, 1)
+	if err != nil {
+		return err
+	}
+	m.Queries = fields[0]
+	return nil
+}
+
+func (m *ScoresMessage) MarshalBinary() ([]byte, error) {
+	return encodeFields(RoundScores, [][]byte{m.Scores}), nil
+}
+
+func (m *ScoresMessage) UnmarshalBinary(data []byte) error {
+	fields, err := decodeFields(data, RoundScores, 1)
+	if err != nil {
+		return err
+	}
+	m.Scores = fields[0]
+	return nil
+}
+
+// encodeFields writes the round tag, the ProtocolVersion, the field count and
+// every field with a uint32 length prefix, all big endian.
+func encodeFields(round Round, fields [][]byte) []byte {
+	size := frameSize
+	for _, f := range fields {
+		size += 4 + len(f)
+	}
+	buf := make([]byte, 0, size)
+	buf = append(buf, byte(round))
+	buf = binary.BigEndian.AppendUint16(buf, ProtocolVersion)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(fields)))
+	for _, f := range fields {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(f)))
+		buf = append(buf, f...)
+	}
+	return buf
+}
+
+// frameSize is the length of the round tag, version and field count.
+const frameSize = 1 + 2 + 4
+
+// decodeFields reverses encodeFields, checking the round tag, the version and
+// that at least minFields fields are present.
+func decodeFields(data []byte, round Round, minFields int) ([][]byte, error) {
+	if len(data) < frameSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMalformedMessage, len(data))
+	}
+	if got := Round(data[0]); got != round {
+		return nil, fmt.Errorf("%w: %s message, expected %s", ErrMalformedMessage, got, round)
+	}
+	if version := binary.BigEndian.Uint16(data[1:]); version != ProtocolVersion {
+		return nil, fmt.Errorf("%w: %d, expected %d", ErrUnsupportedVersion, version, ProtocolVersion)
+	}
+	n := int(binary.BigEndian.Uint32(data[3:]))
+	if n < minFields {
+		return nil, fmt.Errorf("%w: %d fields, expected at least %d", ErrMalformedMessage, n, minFields)
+	}
+	data = data[frameSize:]
+	fields := make([][]byte, 0, min(n, len(data)/4))
+	for i := 0; i < n; i++ {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("%w: truncated at field %d", ErrMalformedMessage, i)
+		}
+		size := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		if uint64(len(data)) < uint64(size) {
+			return nil, fmt.Errorf("%w: truncated at field %d", ErrMalformedMessage, i)
+		}
+		fields = append(fields, data[:size:size])
+		data = data[size:]
+	}
+	if len(data) != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrMalformedMessage, len(data))
+	}
+	return fields, nil
+}
+
+func uint32Field(v int) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(v))
+}
+
+func readUint32Field(f []byte) (int, error) {
+	if len(f) != 4 {
+		return 0, fmt.Errorf("%w: integer field of %d bytes", ErrMalformedMessage, len(f))
+	}
+	return int(binary.BigEndian.Uint32(f)), nil
+}
@@ -0,0 +1,143 @@
+package fpsi
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/data"
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/hem"
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/serialization"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+)
+
+// Receiver is the querying party. It owns the HE keys and is the only one
+// that learns the scores.
+type Receiver struct {
+	profile    hem.Profile
+	vectorizer *data.TfidfVectorizer
+	pipeline   *data.Pipeline
+
+	enc      *hem.EncryptorContext
+	dec      *hem.DecryptorContext
+	next     Round
+	nQueries int
+}
+
+// NewReceiver creates a Receiver that generates keys from profile on a ring
+// sized for vectorizer. The vectorizer is either fitted on a corpus both
+// parties accept, or built with FitAlphabet so that no corpus is needed and
+// no n-gram of the Receiver's names is revealed.
+func NewReceiver(profile hem.Profile, vectorizer *data.TfidfVectorizer) *Receiver {
+	return &Receiver{profile: profile, vectorizer: vectorizer, pipeline: data.DefaultPipeline(), next: RoundSetup}
+}
+
+// SetPipeline replaces the default cleaning pipeline, which cleans like
+// data.CleanCompanyName. The Sender must use the same one.
+func (r *Receiver) SetPipeline(pipeline *data.Pipeline) {
+	r.pipeline = pipeline
+}
+
+// Setup generates the key set and returns the parameters and vocabulary the
+// Sender must use, with the hash of the vectorizer so that the Sender can check
+// it rebuilt or loaded the same model, and the cleaning pipeline. For an alphabet vectorizer only the
+// alphabet is sent.
+func (r *Receiver) Setup() (*SetupMessage, error) {
+	if r.next != RoundSetup {
+		return nil, outOfOrder(RoundSetup, r.next)
+	}
+	enc, dec, _, err := hem.GenerateContextsForVectorizer(r.profile, r.vectorizer, nil)
+	if err != nil {
+		return nil, err
+	}
+	params, err := serialization.MarshalParameters(dec.Params())
+	if err != nil {
+		return nil, err
+	}
+	r.enc, r.dec = enc, dec
+	r.next = RoundKeys
+	minN, maxN := r.vectorizer.NgramRange()
+	hash := r.vectorizer.Hash()
+	pipelineHash := r.pipeline.Hash()
+	msg := &SetupMessage{
+		Params:         params,
+		Analyzer:       r.vectorizer.Analyzer,
+		NgramLength:    minN,
+		MaxNgramLength: maxN,
+		MinDF:          r.vectorizer.MinDF,
+		Phonetics:      r.vectorizer.Phonetics,
+		Alphabet:       r.vectorizer.Alphabet,
+		SmoothIDF:      r.vectorizer.SmoothIDF,
+		SublinearTF:    r.vectorizer.SublinearTF,
+		Normalize:      r.vectorizer.Normalize,
+		ModelHash:      hash[:],
+
+		PipelineVersion: r.pipeline.Version(),
+		PipelineHash:    pipelineHash[:],
+	}
+	if msg.Alphabet == "" {
+		msg.Vocabulary = append([]string(nil), r.vectorizer.Vocabulary.Keys...)
+		msg.NumDocs = r.vectorizer.NumDocs
+		msg.DocFreq = append([]int(nil), r.vectorizer.DocFreq...)
+	}
+	return msg, nil
+}
+
+// Keys exports the evaluation keys. The secret key never leaves the Receiver.
+func (r *Receiver) Keys() (*KeysMessage, error) {
+	if r.next != RoundKeys {
+		return nil, outOfOrder(RoundKeys, r.next)
+	}
+	params := r.dec.Params()
+	rlk, gks := r.enc.EvaluationKeys()
+	rlkData, err := serialization.MarshalRelinearizationKey(params, rlk)
+	if err != nil {
+		return nil, err
+	}
+	gksData, err := serialization.MarshalGaloisKeys(params, gks)
+	if err != nil {
+		return nil, err
+	}
+	r.next = RoundQuery
+	return &KeysMessage{RelinearizationKey: rlkData, GaloisKeys: gksData}, nil
+}
+
+// Query encrypts the query names. It can be called again for a new batch once
+// the scores of the previous one were read.
+func (r *Receiver) Query(ctx context.Context, names []string) (*QueryMessage, error) {
+	if r.next != RoundQuery {
+		return nil, outOfOrder(RoundQuery, r.next)
+	}
+	cts, err := r.enc.BatchEncrypt(ctx, vectorize(r.vectorizer, r.pipeline, names))
+	if err != nil {
+		return nil, err
+	}
+	queries, err := serialization.MarshalCiphertextMatrix(r.dec.Params(), [][]*rlwe.Ciphertext{cts})
+	if err != nil {
+		return nil, err
+	}
+	r.nQueries = len(names)
+	r.next = RoundScores
+	return &QueryMessage{Queries: queries}, nil
+}
+
+// Scores decrypts the Sender's answer into a query x store similarity matrix.
+func (r *Receiver) Scores(ctx context.Context, msg *ScoresMessage) ([][]float64, error) {
+	if r.next != RoundScores {
+		return nil, outOfOrder(RoundScores, r.next)
+	}
+	// The serializer rejects ciphertexts that do not fit the parameters,
+	// which would otherwise panic while decrypting.
+	matrix, err := serialization.UnmarshalCiphertextMatrix(r.dec.Params(), msg.Scores)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformedMessage, err)
+	}
+	if len(matrix) != r.nQueries {
+		return nil, fmt.Errorf("%w: %d score rows for %d queries", ErrMalformedMessage, len(matrix), r.nQueries)
+	}
+	scores, err := r.dec.CosineSimMatrixDecrypt(ctx, matrix)
+	if err != nil {
+		return nil, err
+	}
+	r.next = RoundQuery
+	return scores, nil
+}
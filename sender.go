@@ -0,0 +1,160 @@
+package fpsi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/data"
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/hem"
+	"github.com/Zorrat/Fuzzy-Private-Entity-Set-Intersection.git/serialization"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+)
+
+// Sender is the party holding the store. It scores encrypted queries against
+// its names in the clear and never sees a query or a score.
+type Sender struct {
+	store    []string
+	security hem.SecurityLevel
+	model    *data.TfidfVectorizer
+	pipeline *data.Pipeline
+
+	params  ckks.Parameters
+	vectors [][]float64
+	eval    *hem.EvaluatorContext
+	next    Round
+}
+
+// NewSender creates a Sender for store. It refuses parameters from the
+// Receiver that do not reach security.
+func NewSender(store []string, security hem.SecurityLevel) *Sender {
+	return &Sender{store: store, security: security, pipeline: data.DefaultPipeline(), next: RoundSetup}
+}
+
+// NewSenderWithModel creates a Sender that vectorizes its store with model,
+// typically one loaded with data.TfidfVectorizer.Load, and refuses a Receiver
+// whose vectorizer has a different hash.
+func NewSenderWithModel(store []string, security hem.SecurityLevel, model *data.TfidfVectorizer) *Sender {
+	return &Sender{store: store, security: security, model: model, pipeline: data.DefaultPipeline(), next: RoundSetup}
+}
+
+// SetPipeline replaces the default cleaning pipeline, which cleans like
+// data.CleanCompanyName. HandleSetup refuses a Receiver using another one.
+func (s *Sender) SetPipeline(pipeline *data.Pipeline) {
+	s.pipeline = pipeline
+}
+
+// HandleSetup checks the Receiver's parameters and vectorizes the store with
+// the agreed vocabulary, expanding it from the alphabet if one was sent. A
+// Sender with its own model only checks that the Receiver uses the same one.
+func (s *Sender) HandleSetup(msg *SetupMessage) error {
+	if s.next != RoundSetup {
+		return outOfOrder(RoundSetup, s.next)
+	}
+	params, err := serialization.UnmarshalParameters(msg.Params)
+	if err != nil {
+		return err
+	}
+	if _, err := hem.NewProfile("receiver", params.ParametersLiteral(), s.security); err != nil {
+		return fmt.Errorf("rejecting receiver parameters: %w", err)
+	}
+
+	if hash := s.pipeline.Hash(); !bytes.Equal(hash[:], msg.PipelineHash) {
+		return fmt.Errorf("%w: receiver uses %s %x, expected %s", ErrPipelineMismatch, msg.PipelineVersion, msg.PipelineHash, s.pipeline.ID())
+	}
+
+	vectorizer := s.model
+	if vectorizer == nil {
+		if vectorizer, err = vectorizerFromSetup(msg); err != nil {
+			return err
+		}
+	}
+	if hash := vectorizer.Hash(); !bytes.Equal(hash[:], msg.ModelHash) {
+		return fmt.Errorf("%w: hash %x, expected %x", ErrModelMismatch, msg.ModelHash, hash)
+	}
+	if size := vectorizer.Vocabulary.Size(); size > params.MaxSlots() {
+		return fmt.Errorf("vocabulary of %d terms does not fit %d slots", size, params.MaxSlots())
+	}
+	s.params = params
+	s.vectors = vectorize(vectorizer, s.pipeline, s.store)
+	s.next = RoundKeys
+	return nil
+}
+
+// vectorizerFromSetup rebuilds the Receiver's vectorizer from msg.
+func vectorizerFromSetup(msg *SetupMessage) (*data.TfidfVectorizer, error) {
+	vectorizer, err := data.NewTfidfVectorizerRange(msg.Analyzer, msg.NgramLength, msg.MaxNgramLength, msg.MinDF)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	for _, p := range msg.Phonetics {
+		if !p.Valid() {
+			return nil, fmt.Errorf("%w: unknown phonetic encoder %s", ErrMalformedMessage, p)
+		}
+	}
+	vectorizer.Phonetics = msg.Phonetics
+	if msg.Alphabet != "" {
+		if err := vectorizer.FitAlphabet(msg.Alphabet); err != nil {
+			return nil, err
+		}
+	} else {
+		if msg.DocFreq != nil && len(msg.DocFreq) != len(msg.Vocabulary) {
+			return nil, fmt.Errorf("%w: %d document frequencies for %d terms", ErrMalformedMessage, len(msg.DocFreq), len(msg.Vocabulary))
+		}
+		if err := data.CheckDocFreq(msg.DocFreq, msg.NumDocs); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+		}
+		for _, term := range msg.Vocabulary {
+			vectorizer.Vocabulary.Set(term)
+		}
+		vectorizer.NumDocs, vectorizer.DocFreq = msg.NumDocs, msg.DocFreq
+	}
+	vectorizer.SmoothIDF = msg.SmoothIDF
+	vectorizer.SublinearTF = msg.SublinearTF
+	vectorizer.Normalize = msg.Normalize
+	return vectorizer, nil
+}
+
+// HandleKeys builds the evaluator from the Receiver's evaluation keys.
+func (s *Sender) HandleKeys(msg *KeysMessage) error {
+	if s.next != RoundKeys {
+		return outOfOrder(RoundKeys, s.next)
+	}
+	rlk, err := serialization.UnmarshalRelinearizationKey(s.params, msg.RelinearizationKey)
+	if err != nil {
+		return err
+	}
+	gks, err := serialization.UnmarshalGaloisKeys(s.params, msg.GaloisKeys)
+	if err != nil {
+		return err
+	}
+	s.eval = hem.NewEvaluatorContext(s.params, rlk, gks)
+	s.next = RoundQuery
+	return nil
+}
+
+// HandleQuery scores every encrypted query against every store entry. It can
+// be called once per query batch.
+func (s *Sender) HandleQuery(ctx context.Context, msg *QueryMessage) (*ScoresMessage, error) {
+	if s.next != RoundQuery {
+		return nil, outOfOrder(RoundQuery, s.next)
+	}
+	// The serializer rejects ciphertexts that do not fit the parameters,
+	// which would otherwise panic inside the evaluator.
+	matrix, err := serialization.UnmarshalCiphertextMatrix(s.params, msg.Queries)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformedMessage, err)
+	}
+	if len(matrix) != 1 {
+		return nil, fmt.Errorf("%w: %d query rows, expected 1", ErrMalformedMessage, len(matrix))
+	}
+	scores, err := s.eval.BatchDotProduct(ctx, matrix[0], s.vectors)
+	if err != nil {
+		return nil, err
+	}
+	out, err := serialization.MarshalCiphertextMatrix(s.params, scores)
+	if err != nil {
+		return nil, err
+	}
+	return &ScoresMessage{Scores: out}, nil
+}
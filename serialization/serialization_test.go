@@ -1 +1,241 @@
 package serialization
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/ring"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+)
+
+func testParameters(t *testing.T, logN int) ckks.Parameters {
+	params, err := ckks.NewParametersFromLiteral(ckks.ParametersLiteral{
+		LogN:            logN,
+		LogQ:            []int{45, 35, 35},
+		LogP:            []int{40},
+		LogDefaultScale: 35,
+		RingType:        ring.ConjugateInvariant,
+	})
+	assert.NoError(t, err)
+	return params
+}
+
+func TestParametersRoundTrip(t *testing.T) {
+	params := testParameters(t, 8)
+	data, err := MarshalParameters(params)
+	assert.NoError(t, err)
+
+	decoded, err := UnmarshalParameters(data)
+	assert.NoError(t, err)
+	assert.True(t, params.Equal(&decoded), "Decoded parameters should match")
+
+	h, err := ReadHeader(data)
+	assert.NoError(t, err)
+	assert.Equal(t, KindParameters, h.Kind)
+	assert.Equal(t, FormatVersion, h.Version)
+}
+
+func TestKeysRoundTrip(t *testing.T) {
+	params := testParameters(t, 8)
+	kgen := ckks.NewKeyGenerator(params)
+	sk, pk := kgen.GenKeyPairNew()
+	rlk := kgen.GenRelinearizationKeyNew(sk)
+	gks := kgen.GenGaloisKeysNew(params.GaloisElementsForInnerSum(1, params.MaxSlots()), sk)
+
+	data, err := MarshalPublicKey(params, pk)
+	assert.NoError(t, err)
+	decodedPk, err := UnmarshalPublicKey(params, data)
+	assert.NoError(t, err)
+	assert.True(t, pk.Equal(decodedPk), "Decoded public key should match")
+
+	data, err = MarshalSecretKey(params, sk)
+	assert.NoError(t, err)
+	decodedSk, err := UnmarshalSecretKey(params, data)
+	assert.NoError(t, err)
+	assert.True(t, sk.Equal(decodedSk), "Decoded secret key should match")
+
+	data, err = MarshalRelinearizationKey(params, rlk)
+	assert.NoError(t, err)
+	decodedRlk, err := UnmarshalRelinearizationKey(params, data)
+	assert.NoError(t, err)
+	assert.True(t, rlk.Equal(&decodedRlk.GadgetCiphertext), "Decoded relinearization key should match")
+
+	data, err = MarshalGaloisKeys(params, gks)
+	assert.NoError(t, err)
+	decodedGks, err := UnmarshalGaloisKeys(params, data)
+	assert.NoError(t, err)
+	assert.Equal(t, len(gks), len(decodedGks))
+	for i := range gks {
+		assert.Equal(t, gks[i].GaloisElement, decodedGks[i].GaloisElement)
+		assert.True(t, gks[i].Equal(&decodedGks[i].GadgetCiphertext), "Decoded galois key %d should match", i)
+	}
+}
+
+func TestCiphertextRoundTrip(t *testing.T) {
+	params := testParameters(t, 8)
+	kgen := ckks.NewKeyGenerator(params)
+	sk, pk := kgen.GenKeyPairNew()
+	encoder := ckks.NewEncoder(params)
+	encryptor := rlwe.NewEncryptor(params, pk)
+	decryptor := rlwe.NewDecryptor(params, sk)
+
+	values := []float64{0.5, -0.25, 0.125}
+	pt := ckks.NewPlaintext(params, params.MaxLevel())
+	assert.NoError(t, encoder.Encode(values, pt))
+	ct, err := encryptor.EncryptNew(pt)
+	assert.NoError(t, err)
+
+	data, err := MarshalCiphertext(params, ct)
+	assert.NoError(t, err)
+	decoded, err := UnmarshalCiphertext(params, data)
+	assert.NoError(t, err)
+
+	out := make([]float64, params.MaxSlots())
+	assert.NoError(t, encoder.Decode(decryptor.DecryptNew(decoded), out))
+	assert.InDeltaSlice(t, values, out[:len(values)], 1e-5)
+
+	matrix := [][]*rlwe.Ciphertext{{ct, nil}, {}, {ct}}
+	data, err = MarshalCiphertextMatrix(params, matrix)
+	assert.NoError(t, err)
+	decodedMatrix, err := UnmarshalCiphertextMatrix(params, data)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(decodedMatrix))
+	assert.Equal(t, 2, len(decodedMatrix[0]))
+	assert.Nil(t, decodedMatrix[0][1], "Nil entries should be preserved")
+	assert.Empty(t, decodedMatrix[1])
+	assert.True(t, ct.Equal(decodedMatrix[2][0]), "Decoded ciphertext should match")
+}
+
+func TestRejectsCorruptMessages(t *testing.T) {
+	params := testParameters(t, 8)
+	other := testParameters(t, 9)
+	_, pk := ckks.NewKeyGenerator(params).GenKeyPairNew()
+	data, err := MarshalPublicKey(params, pk)
+	assert.NoError(t, err)
+
+	corrupt := func(f func([]byte)) []byte {
+		c := append([]byte(nil), data...)
+		f(c)
+		return c
+	}
+
+	_, err = UnmarshalPublicKey(params, corrupt(func(b []byte) { b[0] = 'X' }))
+	assert.True(t, errors.Is(err, ErrBadMagic), "Bad magic should be rejected: %v", err)
+
+	_, err = UnmarshalPublicKey(params, corrupt(func(b []byte) { binary.BigEndian.PutUint16(b[4:], FormatVersion+1) }))
+	assert.True(t, errors.Is(err, ErrUnsupportedVersion), "Unknown version should be rejected: %v", err)
+
+	_, err = UnmarshalPublicKey(params, corrupt(func(b []byte) { b[len(b)-1] ^= 0xff }))
+	assert.True(t, errors.Is(err, ErrChecksum), "Flipped payload byte should be rejected: %v", err)
+
+	_, err = UnmarshalPublicKey(params, data[:len(data)-1])
+	assert.True(t, errors.Is(err, ErrTruncated), "Truncated message should be rejected: %v", err)
+
+	_, err = UnmarshalPublicKey(other, data)
+	assert.True(t, errors.Is(err, ErrParameterMismatch), "Key under other parameters should be rejected: %v", err)
+
+	_, err = UnmarshalCiphertext(params, data)
+	assert.True(t, errors.Is(err, ErrUnexpectedKind), "Public key is not a ciphertext: %v", err)
+}
+
+func TestRejectsForgedCounts(t *testing.T) {
+	params := testParameters(t, 8)
+	fp, err := Fingerprint(params)
+	assert.NoError(t, err)
+	// A valid header and checksum over a payload claiming far more entries
+	// than it holds must fail before anything is allocated for them.
+	forged := func(kind Kind, counts ...uint32) []byte {
+		var payload []byte
+		for _, n := range counts {
+			payload = binary.BigEndian.AppendUint32(payload, n)
+		}
+		return seal(kind, fp, payload)
+	}
+
+	_, err = UnmarshalCiphertextMatrix(params, forged(KindCiphertextMatrix, 0xFFFFFFF0))
+	assert.True(t, errors.Is(err, ErrTruncated), "Forged row count: %v", err)
+	_, err = UnmarshalCiphertextMatrix(params, forged(KindCiphertextMatrix, 1, 0xFFFFFFF0))
+	assert.True(t, errors.Is(err, ErrTruncated), "Forged column count: %v", err)
+	_, err = UnmarshalGaloisKeys(params, forged(KindGaloisKeys, 0xFFFFFFF0))
+	assert.True(t, errors.Is(err, ErrTruncated), "Forged key count: %v", err)
+
+	// Counts the payload can hold still decode.
+	matrix, err := UnmarshalCiphertextMatrix(params, seal(KindCiphertextMatrix, fp, []byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 0}))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]*rlwe.Ciphertext{{nil, nil}}, matrix)
+}
+
+func TestRejectsObjectsNotFittingParameters(t *testing.T) {
+	params := testParameters(t, 8)
+	deeper, err := ckks.NewParametersFromLiteral(ckks.ParametersLiteral{
+		LogN:            8,
+		LogQ:            []int{45, 35, 35, 35},
+		LogP:            []int{40},
+		LogDefaultScale: 35,
+		RingType:        ring.ConjugateInvariant,
+	})
+	assert.NoError(t, err)
+	wider := testParameters(t, 9)
+
+	// The fingerprint is the receiving party's own, so only the objects
+	// themselves give them away.
+	for name, ct := range map[string]*rlwe.Ciphertext{
+		"degree 2":            ckks.NewCiphertext(params, 2, params.MaxLevel()),
+		"above the max level": ckks.NewCiphertext(deeper, 1, deeper.MaxLevel()),
+		"larger ring":         ckks.NewCiphertext(wider, 1, wider.MaxLevel()),
+	} {
+		data, err := MarshalCiphertext(params, ct)
+		assert.NoError(t, err)
+		_, err = UnmarshalCiphertext(params, data)
+		assert.True(t, errors.Is(err, ErrInvalidObject), "Ciphertext %s: %v", name, err)
+		data, err = MarshalCiphertextMatrix(params, [][]*rlwe.Ciphertext{{nil, ct}})
+		assert.NoError(t, err)
+		_, err = UnmarshalCiphertextMatrix(params, data)
+		assert.True(t, errors.Is(err, ErrInvalidObject), "Matrix with a ciphertext %s: %v", name, err)
+	}
+
+	for name, other := range map[string]ckks.Parameters{"above the max level": deeper, "larger ring": wider} {
+		kgen := ckks.NewKeyGenerator(other)
+		sk := kgen.GenSecretKeyNew()
+		data, err := MarshalRelinearizationKey(params, kgen.GenRelinearizationKeyNew(sk))
+		assert.NoError(t, err)
+		_, err = UnmarshalRelinearizationKey(params, data)
+		assert.True(t, errors.Is(err, ErrInvalidObject), "Relinearization key %s: %v", name, err)
+		data, err = MarshalGaloisKeys(params, kgen.GenGaloisKeysNew([]uint64{other.GaloisElement(1)}, sk))
+		assert.NoError(t, err)
+		_, err = UnmarshalGaloisKeys(params, data)
+		assert.True(t, errors.Is(err, ErrInvalidObject), "Galois key %s: %v", name, err)
+	}
+}
+
+func TestRejectsTrailingData(t *testing.T) {
+	params := testParameters(t, 8)
+	fp, err := Fingerprint(params)
+	assert.NoError(t, err)
+	kgen := ckks.NewKeyGenerator(params)
+	sk, pk := kgen.GenKeyPairNew()
+	ct := rlwe.NewEncryptor(params, pk).EncryptZeroNew(params.MaxLevel())
+	// Appends to the payload of data and reseals it with a valid checksum.
+	extend := func(data []byte, kind Kind) []byte {
+		payload := append([]byte(nil), data[HeaderSize:]...)
+		return seal(kind, fp, append(payload, 0))
+	}
+
+	data, err := MarshalCiphertext(params, ct)
+	assert.NoError(t, err)
+	_, err = UnmarshalCiphertext(params, extend(data, KindCiphertext))
+	assert.True(t, errors.Is(err, ErrTrailingData), "Ciphertext: %v", err)
+
+	data, err = MarshalCiphertextMatrix(params, [][]*rlwe.Ciphertext{{ct}})
+	assert.NoError(t, err)
+	_, err = UnmarshalCiphertextMatrix(params, extend(data, KindCiphertextMatrix))
+	assert.True(t, errors.Is(err, ErrTrailingData), "Ciphertext matrix: %v", err)
+
+	data, err = MarshalGaloisKeys(params, kgen.GenGaloisKeysNew([]uint64{params.GaloisElement(1)}, sk))
+	assert.NoError(t, err)
+	_, err = UnmarshalGaloisKeys(params, extend(data, KindGaloisKeys))
+	assert.True(t, errors.Is(err, ErrTrailingData), "Galois keys: %v", err)
+}
@@ -1 +1,511 @@
+// Package serialization implements the binary wire format the FPSI parties use
+// to exchange HE parameters, keys and ciphertexts.
+//
+// Every message starts with a fixed header:
+//
+//	magic       [4]byte  "FPSI"
+//	version     uint16   FormatVersion
+//	kind        uint8    what the payload holds
+//	fingerprint [32]byte SHA-256 of the ckks parameters the payload belongs to
+//	length      uint64   payload length in bytes
+//	checksum    uint32   CRC-32 (IEEE) of the payload
+//
+// All integers are big endian. Keys and ciphertexts can only be decoded under
+// parameters whose fingerprint matches the one in the header. Since the
+// sender controls that header, decoded keys and ciphertexts are also checked
+// against the parameters themselves.
 package serialization
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+)
+
+// FormatVersion is the version written into every header. Decoding rejects
+// any other version.
+const FormatVersion uint16 = 1
+
+// HeaderSize is the length in bytes of the header preceding every payload.
+const HeaderSize = 4 + 2 + 1 + sha256.Size + 8 + 4
+
+var magic = [4]byte{'F', 'P', 'S', 'I'}
+
+var (
+	ErrBadMagic           = errors.New("serialization: not an FPSI message")
+	ErrUnsupportedVersion = errors.New("serialization: unsupported format version")
+	ErrChecksum           = errors.New("serialization: checksum mismatch")
+	ErrParameterMismatch  = errors.New("serialization: parameter fingerprint mismatch")
+	ErrUnexpectedKind     = errors.New("serialization: unexpected payload kind")
+	ErrTruncated          = errors.New("serialization: truncated message")
+	ErrTrailingData       = errors.New("serialization: trailing data")
+	ErrInvalidObject      = errors.New("serialization: object does not fit the parameters")
+)
+
+// Kind identifies what a message payload holds.
+type Kind uint8
+
+const (
+	KindParameters Kind = iota + 1
+	KindPublicKey
+	KindRelinearizationKey
+	KindGaloisKeys
+	KindCiphertext
+	KindCiphertextMatrix
+	KindSecretKey
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindParameters:
+		return "parameters"
+	case KindPublicKey:
+		return "public key"
+	case KindRelinearizationKey:
+		return "relinearization key"
+	case KindGaloisKeys:
+		return "galois keys"
+	case KindCiphertext:
+		return "ciphertext"
+	case KindCiphertextMatrix:
+		return "ciphertext matrix"
+	case KindSecretKey:
+		return "secret key"
+	}
+	return fmt.Sprintf("kind(%d)", uint8(k))
+}
+
+// Header is the decoded message header.
+type Header struct {
+	Version     uint16
+	Kind        Kind
+	Fingerprint [sha256.Size]byte
+	Length      uint64
+	Checksum    uint32
+}
+
+// Fingerprint identifies a parameter set. Two parties holding parameters with
+// the same fingerprint can exchange keys and ciphertexts.
+func Fingerprint(params ckks.Parameters) ([sha256.Size]byte, error) {
+	data, err := params.MarshalBinary()
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
+
+// ReadHeader decodes and validates the header of data without looking at the
+// payload beyond its length and checksum.
+func ReadHeader(data []byte) (Header, error) {
+	var h Header
+	if len(data) < HeaderSize {
+		return h, ErrTruncated
+	}
+	if !bytes.Equal(data[:4], magic[:]) {
+		return h, ErrBadMagic
+	}
+	h.Version = binary.BigEndian.Uint16(data[4:6])
+	if h.Version != FormatVersion {
+		return h, fmt.Errorf("%w: %d", ErrUnsupportedVersion, h.Version)
+	}
+	h.Kind = Kind(data[6])
+	copy(h.Fingerprint[:], data[7:7+sha256.Size])
+	off := 7 + sha256.Size
+	h.Length = binary.BigEndian.Uint64(data[off : off+8])
+	h.Checksum = binary.BigEndian.Uint32(data[off+8 : off+12])
+
+	if uint64(len(data)-HeaderSize) != h.Length {
+		return h, ErrTruncated
+	}
+	if crc32.ChecksumIEEE(data[HeaderSize:]) != h.Checksum {
+		return h, ErrChecksum
+	}
+	return h, nil
+}
+
+func seal(kind Kind, fingerprint [sha256.Size]byte, payload []byte) []byte {
+	out := make([]byte, HeaderSize, HeaderSize+len(payload))
+	copy(out[:4], magic[:])
+	binary.BigEndian.PutUint16(out[4:6], FormatVersion)
+	out[6] = byte(kind)
+	copy(out[7:7+sha256.Size], fingerprint[:])
+	off := 7 + sha256.Size
+	binary.BigEndian.PutUint64(out[off:off+8], uint64(len(payload)))
+	binary.BigEndian.PutUint32(out[off+8:off+12], crc32.ChecksumIEEE(payload))
+	return append(out, payload...)
+}
+
+// open validates data as a message of the given kind under params and
+// returns its payload.
+func open(data []byte, kind Kind, params ckks.Parameters) ([]byte, error) {
+	h, err := ReadHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if h.Kind != kind {
+		return nil, fmt.Errorf("%w: want %s, got %s", ErrUnexpectedKind, kind, h.Kind)
+	}
+	fp, err := Fingerprint(params)
+	if err != nil {
+		return nil, err
+	}
+	if fp != h.Fingerprint {
+		return nil, ErrParameterMismatch
+	}
+	return data[HeaderSize:], nil
+}
+
+func marshal(kind Kind, params ckks.Parameters, obj encoding.BinaryMarshaler) ([]byte, error) {
+	fp, err := Fingerprint(params)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := obj.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return seal(kind, fp, payload), nil
+}
+
+// object is what lattigo keys and ciphertexts implement.
+type object interface {
+	encoding.BinaryUnmarshaler
+	BinarySize() int
+}
+
+func unmarshal(data []byte, kind Kind, params ckks.Parameters, obj object) error {
+	payload, err := open(data, kind, params)
+	if err != nil {
+		return err
+	}
+	return unmarshalExact(payload, obj)
+}
+
+// unmarshalExact decodes obj from data, which must hold nothing else.
+func unmarshalExact(data []byte, obj object) error {
+	if err := obj.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	if size := obj.BinarySize(); size != len(data) {
+		return fmt.Errorf("%w: %d bytes after a %d-byte object", ErrTrailingData, len(data)-size, size)
+	}
+	return nil
+}
+
+// MarshalParameters encodes a parameter set. Its fingerprint is that of the
+// parameters themselves.
+func MarshalParameters(params ckks.Parameters) ([]byte, error) {
+	return marshal(KindParameters, params, params)
+}
+
+// UnmarshalParameters decodes a parameter set and checks it against the
+// fingerprint it was sent with.
+func UnmarshalParameters(data []byte) (ckks.Parameters, error) {
+	var params ckks.Parameters
+	h, err := ReadHeader(data)
+	if err != nil {
+		return params, err
+	}
+	if h.Kind != KindParameters {
+		return params, fmt.Errorf("%w: want %s, got %s", ErrUnexpectedKind, KindParameters, h.Kind)
+	}
+	if err := params.UnmarshalBinary(data[HeaderSize:]); err != nil {
+		return params, err
+	}
+	fp, err := Fingerprint(params)
+	if err != nil {
+		return params, err
+	}
+	if fp != h.Fingerprint {
+		return params, ErrParameterMismatch
+	}
+	return params, nil
+}
+
+// MarshalPublicKey encodes a public key generated under params.
+func MarshalPublicKey(params ckks.Parameters, pk *rlwe.PublicKey) ([]byte, error) {
+	return marshal(KindPublicKey, params, pk)
+}
+
+// UnmarshalPublicKey decodes a public key generated under params.
+func UnmarshalPublicKey(params ckks.Parameters, data []byte) (*rlwe.PublicKey, error) {
+	pk := new(rlwe.PublicKey)
+	if err := unmarshal(data, KindPublicKey, params, pk); err != nil {
+		return nil, err
+	}
+	return pk, nil
+}
+
+// MarshalSecretKey encodes a secret key generated under params. The output is
+// not encrypted; it is meant for the key owner's own storage only.
+func MarshalSecretKey(params ckks.Parameters, sk *rlwe.SecretKey) ([]byte, error) {
+	return marshal(KindSecretKey, params, sk)
+}
+
+// UnmarshalSecretKey decodes a secret key generated under params.
+func UnmarshalSecretKey(params ckks.Parameters, data []byte) (*rlwe.SecretKey, error) {
+	sk := new(rlwe.SecretKey)
+	if err := unmarshal(data, KindSecretKey, params, sk); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
+
+// MarshalRelinearizationKey encodes a relinearization key generated under params.
+func MarshalRelinearizationKey(params ckks.Parameters, rlk *rlwe.RelinearizationKey) ([]byte, error) {
+	return marshal(KindRelinearizationKey, params, rlk)
+}
+
+// UnmarshalRelinearizationKey decodes a relinearization key generated under params.
+func UnmarshalRelinearizationKey(params ckks.Parameters, data []byte) (*rlwe.RelinearizationKey, error) {
+	rlk := new(rlwe.RelinearizationKey)
+	if err := unmarshal(data, KindRelinearizationKey, params, rlk); err != nil {
+		return nil, err
+	}
+	if err := checkGadget(params, &rlk.GadgetCiphertext); err != nil {
+		return nil, err
+	}
+	return rlk, nil
+}
+
+// MarshalCiphertext encodes a single ciphertext.
+func MarshalCiphertext(params ckks.Parameters, ct *rlwe.Ciphertext) ([]byte, error) {
+	return marshal(KindCiphertext, params, ct)
+}
+
+// UnmarshalCiphertext decodes a single degree-1 ciphertext.
+func UnmarshalCiphertext(params ckks.Parameters, data []byte) (*rlwe.Ciphertext, error) {
+	ct := new(rlwe.Ciphertext)
+	if err := unmarshal(data, KindCiphertext, params, ct); err != nil {
+		return nil, err
+	}
+	if err := checkCiphertext(params, ct); err != nil {
+		return nil, err
+	}
+	return ct, nil
+}
+
+// MarshalGaloisKeys encodes a list of Galois keys generated under params.
+func MarshalGaloisKeys(params ckks.Parameters, gks []*rlwe.GaloisKey) ([]byte, error) {
+	fp, err := Fingerprint(params)
+	if err != nil {
+		return nil, err
+	}
+	var payload []byte
+	payload = binary.BigEndian.AppendUint32(payload, uint32(len(gks)))
+	for _, gk := range gks {
+		if payload, err = appendObject(payload, gk); err != nil {
+			return nil, err
+		}
+	}
+	return seal(KindGaloisKeys, fp, payload), nil
+}
+
+// UnmarshalGaloisKeys decodes a list of Galois keys generated under params.
+func UnmarshalGaloisKeys(params ckks.Parameters, data []byte) ([]*rlwe.GaloisKey, error) {
+	payload, err := open(data, KindGaloisKeys, params)
+	if err != nil {
+		return nil, err
+	}
+	n, payload, err := readUint32(payload)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCount(n, payload, 8); err != nil {
+		return nil, err
+	}
+	gks := make([]*rlwe.GaloisKey, n)
+	for i := range gks {
+		gks[i] = new(rlwe.GaloisKey)
+		if payload, err = readObject(payload, gks[i]); err != nil {
+			return nil, err
+		}
+		if err := checkGadget(params, &gks[i].GadgetCiphertext); err != nil {
+			return nil, fmt.Errorf("galois key %d: %w", i, err)
+		}
+	}
+	if err := checkEnd(payload); err != nil {
+		return nil, err
+	}
+	return gks, nil
+}
+
+// MarshalCiphertextMatrix encodes a matrix of ciphertexts as returned by
+// BatchDotProduct. Rows may differ in length and nil entries are preserved.
+func MarshalCiphertextMatrix(params ckks.Parameters, matrix [][]*rlwe.Ciphertext) ([]byte, error) {
+	fp, err := Fingerprint(params)
+	if err != nil {
+		return nil, err
+	}
+	var payload []byte
+	payload = binary.BigEndian.AppendUint32(payload, uint32(len(matrix)))
+	for _, row := range matrix {
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(row)))
+		for _, ct := range row {
+			if ct == nil {
+				payload = append(payload, 0)
+				continue
+			}
+			payload = append(payload, 1)
+			if payload, err = appendObject(payload, ct); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return seal(KindCiphertextMatrix, fp, payload), nil
+}
+
+// UnmarshalCiphertextMatrix decodes a matrix of degree-1 ciphertexts.
+func UnmarshalCiphertextMatrix(params ckks.Parameters, data []byte) ([][]*rlwe.Ciphertext, error) {
+	payload, err := open(data, KindCiphertextMatrix, params)
+	if err != nil {
+		return nil, err
+	}
+	rows, payload, err := readUint32(payload)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCount(rows, payload, 4); err != nil {
+		return nil, err
+	}
+	matrix := make([][]*rlwe.Ciphertext, rows)
+	for i := range matrix {
+		var cols uint32
+		if cols, payload, err = readUint32(payload); err != nil {
+			return nil, err
+		}
+		if err := checkCount(cols, payload, 1); err != nil {
+			return nil, err
+		}
+		matrix[i] = make([]*rlwe.Ciphertext, cols)
+		for j := range matrix[i] {
+			if len(payload) < 1 {
+				return nil, ErrTruncated
+			}
+			present := payload[0]
+			payload = payload[1:]
+			if present == 0 {
+				continue
+			}
+			matrix[i][j] = new(rlwe.Ciphertext)
+			if payload, err = readObject(payload, matrix[i][j]); err != nil {
+				return nil, err
+			}
+			if err := checkCiphertext(params, matrix[i][j]); err != nil {
+				return nil, fmt.Errorf("ciphertext (%d,%d): %w", i, j, err)
+			}
+		}
+	}
+	if err := checkEnd(payload); err != nil {
+		return nil, err
+	}
+	return matrix, nil
+}
+
+// appendObject appends obj to buf prefixed by its encoded length.
+func appendObject(buf []byte, obj encoding.BinaryMarshaler) ([]byte, error) {
+	data, err := obj.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(data)))
+	return append(buf, data...), nil
+}
+
+// readObject decodes a length-prefixed object from buf and returns the rest.
+func readObject(buf []byte, obj object) ([]byte, error) {
+	if len(buf) < 8 {
+		return nil, ErrTruncated
+	}
+	n := binary.BigEndian.Uint64(buf)
+	buf = buf[8:]
+	if uint64(len(buf)) < n {
+		return nil, ErrTruncated
+	}
+	if err := unmarshalExact(buf[:n], obj); err != nil {
+		return nil, err
+	}
+	return buf[n:], nil
+}
+
+// checkEnd rejects a payload with bytes left after its last entry.
+func checkEnd(buf []byte) error {
+	if len(buf) != 0 {
+		return fmt.Errorf("%w: %d bytes after the last entry", ErrTrailingData, len(buf))
+	}
+	return nil
+}
+
+// checkCiphertext rejects a ciphertext that params cannot evaluate or
+// decrypt: lattigo panics on one of another degree, above the maximum level
+// or on another ring.
+func checkCiphertext(params ckks.Parameters, ct *rlwe.Ciphertext) error {
+	if ct.Degree() != 1 || ct.Level() > params.MaxLevel() {
+		return fmt.Errorf("%w: ciphertext of degree %d at level %d", ErrInvalidObject, ct.Degree(), ct.Level())
+	}
+	for _, poly := range ct.Value {
+		if poly.N() != params.N() || poly.Level() != ct.Level() {
+			return fmt.Errorf("%w: ciphertext on a ring of degree %d at level %d", ErrInvalidObject, poly.N(), poly.Level())
+		}
+	}
+	return nil
+}
+
+// checkGadget checks the shape of an evaluation key: the number of
+// decomposition entries its levels need, each a degree-1 pair of polynomials
+// at those levels on the ring of params.
+func checkGadget(params ckks.Parameters, gadget *rlwe.GadgetCiphertext) error {
+	if len(gadget.Value) == 0 || len(gadget.Value[0]) == 0 || len(gadget.Value[0][0]) == 0 {
+		return fmt.Errorf("%w: empty evaluation key", ErrInvalidObject)
+	}
+	levelQ, levelP := gadget.LevelQ(), gadget.LevelP()
+	if levelQ < 0 || levelQ > params.MaxLevelQ() || levelP > params.MaxLevelP() {
+		return fmt.Errorf("%w: evaluation key at levels %d and %d", ErrInvalidObject, levelQ, levelP)
+	}
+	rows := params.BaseRNSDecompositionVectorSize(levelQ, levelP)
+	cols := params.BaseTwoDecompositionVectorSize(levelQ, levelP, gadget.BaseTwoDecomposition)
+	if len(gadget.Value) != rows {
+		return fmt.Errorf("%w: evaluation key with %d decomposition rows, expected %d", ErrInvalidObject, len(gadget.Value), rows)
+	}
+	for i, row := range gadget.Value {
+		if len(row) != cols[i] {
+			return fmt.Errorf("%w: evaluation key row %d of length %d, expected %d", ErrInvalidObject, i, len(row), cols[i])
+		}
+		for _, vector := range row {
+			if len(vector) != 2 {
+				return fmt.Errorf("%w: evaluation key entry of degree %d", ErrInvalidObject, len(vector)-1)
+			}
+			for _, poly := range vector {
+				if poly.Q.N() != params.N() || poly.Q.Level() != levelQ || poly.P.Level() != levelP ||
+					(levelP >= 0 && poly.P.N() != params.N()) {
+					return fmt.Errorf("%w: evaluation key on a ring of degree %d", ErrInvalidObject, poly.Q.N())
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkCount rejects a count read off the wire if buf cannot hold that many
+// entries of at least minSize bytes each. The checksum does not stop a
+// forged count, and allocating for one could exhaust memory.
+func checkCount(n uint32, buf []byte, minSize int) error {
+	if uint64(n) > uint64(len(buf)/minSize) {
+		return fmt.Errorf("%w: %d entries in %d bytes", ErrTruncated, n, len(buf))
+	}
+	return nil
+}
+
+func readUint32(buf []byte) (uint32, []byte, error) {
+	if len(buf) < 4 {
+		return 0, nil, ErrTruncated
+	}
+	return binary.BigEndian.Uint32(buf), buf[4:], nil
+}
@@ -41,8 +41,8 @@ func TestCompression(t *testing.T) {
 	log.Printf("Original sizes - tfidf1: %dx%d, tfidf2: %dx%d", 
 		len(tfidf1), len(tfidf1[0]), len(tfidf2), len(tfidf2[0]))
 
-	// Baseline cosine distance
-	d1 := utils.CosineDistanceAll(tfidf1, tfidf2)
+	// Baseline cosine distance, on sparse vectors
+	d1 := utils.SparseCosineDistanceAll(vectorizer.BatchTransformSparse(names1), vectorizer.BatchTransformSparse(names2))
 	log.Printf("Original cosine distance matrix: %dx%d", len(d1), len(d1[0]))
 
 	// Prepare FFT inputs
@@ -248,8 +248,8 @@ func TestMatching(t *testing.T) {
 	log.Printf("Original sizes - tfidf1: %dx%d, tfidf2: %dx%d", 
 		len(tfidf1), len(tfidf1[0]), len(tfidf2), len(tfidf2[0]))
 
-	// Baseline cosine distance
-	d1 := utils.CosineDistanceAll(tfidf1, tfidf2)
+	// Baseline cosine distance, on sparse vectors
+	d1 := utils.SparseCosineDistanceAll(vectorizer.BatchTransformSparse(names1), vectorizer.BatchTransformSparse(names2))
 	log.Printf("Original cosine distance matrix: %dx%d", len(d1), len(d1[0]))
 	// top k matches
 	k := 5
@@ -0,0 +1,106 @@
+package utils
+
+import "math"
+
+// SparseVector holds the non-zero entries of a vector: Values[k] is the entry
+// at Indices[k], with Indices strictly increasing. A TF-IDF vector of a name
+// has a few dozen of them out of thousands of features, so the functions
+// below only touch those.
+type SparseVector struct {
+	Indices []int
+	Values  []float64
+}
+
+// NewSparseVector keeps the non-zero entries of a dense vector.
+func NewSparseVector(dense []float64) SparseVector {
+	var v SparseVector
+	for i, x := range dense {
+		if x != 0 {
+			v.Indices = append(v.Indices, i)
+			v.Values = append(v.Values, x)
+		}
+	}
+	return v
+}
+
+// Dense expands v into a vector of length size, e.g. right before encoding it.
+// Entries at or beyond size are dropped.
+func (v SparseVector) Dense(size int) []float64 {
+	dense := make([]float64, size)
+	for k, i := range v.Indices {
+		if i < size {
+			dense[i] = v.Values[k]
+		}
+	}
+	return dense
+}
+
+// SparseDense expands a batch of sparse vectors, see SparseVector.Dense.
+func SparseDense(vectors []SparseVector, size int) [][]float64 {
+	dense := make([][]float64, len(vectors))
+	for i, v := range vectors {
+		dense[i] = v.Dense(size)
+	}
+	return dense
+}
+
+// SparseDotProduct merges the indices of a and b, so it costs the number of
+// non-zero entries rather than the vector length.
+func SparseDotProduct(a, b SparseVector) float64 {
+	var sum float64
+	for i, j := 0, 0; i < len(a.Indices) && j < len(b.Indices); {
+		switch {
+		case a.Indices[i] < b.Indices[j]:
+			i++
+		case a.Indices[i] > b.Indices[j]:
+			j++
+		default:
+			sum += a.Values[i] * b.Values[j]
+			i++
+			j++
+		}
+	}
+	return sum
+}
+
+// SparseNorm returns the L2 norm of v.
+func SparseNorm(v SparseVector) float64 {
+	var sum float64
+	for _, x := range v.Values {
+		sum += x * x
+	}
+	return math.Sqrt(sum)
+}
+
+// NormalizeSparse scales v to unit L2 norm in place. A zero vector is left
+// as it is.
+func NormalizeSparse(v SparseVector) {
+	n := SparseNorm(v)
+	if n == 0 {
+		return
+	}
+	for k := range v.Values {
+		v.Values[k] /= n
+	}
+}
+
+// SparseCosineDistance is CosineDistance over sparse vectors.
+func SparseCosineDistance(v1, v2 SparseVector) float64 {
+	norm1, norm2 := SparseNorm(v1), SparseNorm(v2)
+	if norm1 == 0 || norm2 == 0 {
+		return 1.0 // Max distance if either vector is zero
+	}
+	return 1.0 - SparseDotProduct(v1, v2)/(norm1*norm2)
+}
+
+// SparseCosineDistanceAll is CosineDistanceAll over sparse vectors.
+func SparseCosineDistanceAll(v1, v2 []SparseVector) [][]float64 {
+	result := make([][]float64, len(v1))
+	for i := range v1 {
+		result[i] = make([]float64, len(v2))
+		for j := range v2 {
+			result[i][j] = SparseCosineDistance(v1[i], v2[j])
+		}
+	}
+	return result
+}
@@ -17,3 +17,23 @@ func TestCosineDistance(t *testing.T) {
 	assert.Equal(t, math.Round(dist1*100)/100, 1.0, "Orthogonal vectors should have cosine distance of 1")
 	assert.True(t, dist2 < 1, "Closer vectors should have smaller cosine distance")
 }
+
+func TestSparseVector(t *testing.T) {
+	a := []float64{0, 3, 0, 0, 4, 0}
+	b := []float64{1, 2, 0, 5, 0, 0}
+	sa, sb := NewSparseVector(a), NewSparseVector(b)
+	assert.Equal(t, []int{1, 4}, sa.Indices)
+	assert.Equal(t, a, sa.Dense(len(a)))
+
+	assert.Equal(t, DotProduct(a, b), SparseDotProduct(sa, sb))
+	assert.Equal(t, 5.0, SparseNorm(sa))
+	assert.Equal(t, CosineDistance(a, b), SparseCosineDistance(sa, sb))
+	assert.Equal(t, CosineDistanceAll([][]float64{a, b}, [][]float64{b}), SparseCosineDistanceAll([]SparseVector{sa, sb}, []SparseVector{sb}))
+	assert.Equal(t, 1.0, SparseCosineDistance(sa, SparseVector{}), "A zero vector is at max distance")
+
+	NormalizeSparse(sa)
+	assert.InDelta(t, 1.0, SparseNorm(sa), 1e-12)
+	zero := SparseVector{}
+	NormalizeSparse(zero)
+	assert.Empty(t, zero.Values)
+}